@@ -0,0 +1,113 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync/atomic"
+)
+
+// ConnInfo 刚accept到, 还没交给任何loop的连接
+type ConnInfo struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// LoopStat 选loop时每个loop的状态, ConnCount包含已经分给它但还没注册完的连接
+type LoopStat struct {
+	ID        int
+	ConnCount int64
+}
+
+/**
+ * LoadBalancer 共用的listener只在第一个loop上accept, 每个新连接调用一次Pick, 返回loops的下标, 连接交给这个loop处理
+ * 只在accept的loop协程上调用, 返回越界时连接留在accept的loop上
+ */
+type LoadBalancer interface {
+	Pick(info ConnInfo, loops []LoopStat) int
+}
+
+// NewLoadBalancer 内置的几种分配方式
+func NewLoadBalancer(balance AcceptBalance) LoadBalancer {
+	switch balance {
+	case Random:
+		return NewRandomBalancer()
+	case LeastConn:
+		return NewLeastConnBalancer()
+	case SourceIPHash:
+		return NewSourceIPHashBalancer()
+	default:
+		return NewRoundRobinBalancer()
+	}
+}
+
+type randomBalancer struct{}
+
+func NewRandomBalancer() LoadBalancer {
+	return randomBalancer{}
+}
+
+func (randomBalancer) Pick(info ConnInfo, loops []LoopStat) int {
+	return rand.Intn(len(loops))
+}
+
+// roundRobinBalancer 用自己的计数器轮流分, 不受连接关闭影响
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func NewRoundRobinBalancer() LoadBalancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Pick(info ConnInfo, loops []LoopStat) int {
+	return int((atomic.AddUint64(&b.next, 1) - 1) % uint64(len(loops)))
+}
+
+// leastConnBalancer 分给当前连接数最少的loop, 一样多时选id小的
+type leastConnBalancer struct{}
+
+func NewLeastConnBalancer() LoadBalancer {
+	return leastConnBalancer{}
+}
+
+func (leastConnBalancer) Pick(info ConnInfo, loops []LoopStat) int {
+	min := 0
+	for i := range loops {
+		if loops[i].ConnCount < loops[min].ConnCount {
+			min = i
+		}
+	}
+	return min
+}
+
+// sourceIPHashBalancer 同一个来源ip总是分到同一个loop, 不是ip地址(比如unix socket)时轮流分
+type sourceIPHashBalancer struct {
+	rr roundRobinBalancer
+}
+
+func NewSourceIPHashBalancer() LoadBalancer {
+	return &sourceIPHashBalancer{}
+}
+
+func (b *sourceIPHashBalancer) Pick(info ConnInfo, loops []LoopStat) int {
+	var ip net.IP
+	switch addr := info.RemoteAddr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	if len(ip) == 0 {
+		return b.rr.Pick(info, loops)
+	}
+	h := fnv.New32a()
+	h.Write(ip.To16())
+	return int(h.Sum32() % uint32(len(loops)))
+}
@@ -0,0 +1,118 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func loopStats(counts ...int64) []LoopStat {
+	loops := make([]LoopStat, len(counts))
+	for i, n := range counts {
+		loops[i] = LoopStat{ID: i, ConnCount: n}
+	}
+	return loops
+}
+
+func tcpInfo(ip string, port int) ConnInfo {
+	return ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: port}}
+}
+
+func TestNewLoadBalancer(t *testing.T) {
+	cases := []struct {
+		balance AcceptBalance
+		want    LoadBalancer
+	}{
+		{RoundRobin, &roundRobinBalancer{}},
+		{Random, randomBalancer{}},
+		{LeastConn, leastConnBalancer{}},
+		{SourceIPHash, &sourceIPHashBalancer{}},
+	}
+	for _, tc := range cases {
+		if got := NewLoadBalancer(tc.balance); reflect.TypeOf(got) != reflect.TypeOf(tc.want) {
+			t.Fatalf("balance %v: got %T, want %T", tc.balance, got, tc.want)
+		}
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	b := NewRoundRobinBalancer()
+	loops := loopStats(5, 0, 9)
+	for i := 0; i < 7; i++ {
+		if got := b.Pick(ConnInfo{}, loops); got != i%3 {
+			t.Fatalf("pick %d = %d, want %d", i, got, i%3)
+		}
+	}
+}
+
+func TestRandomBalancer(t *testing.T) {
+	b := NewRandomBalancer()
+	loops := loopStats(0, 0, 0, 0)
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		got := b.Pick(ConnInfo{}, loops)
+		if got < 0 || got >= len(loops) {
+			t.Fatalf("pick = %d out of range", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) != len(loops) {
+		t.Fatalf("picked only %d of %d loops", len(seen), len(loops))
+	}
+}
+
+func TestLeastConnBalancer(t *testing.T) {
+	b := NewLeastConnBalancer()
+	cases := []struct {
+		counts []int64
+		want   int
+	}{
+		{[]int64{3, 1, 2}, 1},
+		{[]int64{0, 0, 0}, 0},
+		// 一样多时选id小的
+		{[]int64{4, 2, 2}, 1},
+		{[]int64{7}, 0},
+	}
+	for _, tc := range cases {
+		if got := b.Pick(ConnInfo{}, loopStats(tc.counts...)); got != tc.want {
+			t.Fatalf("counts %v: pick = %d, want %d", tc.counts, got, tc.want)
+		}
+	}
+}
+
+func TestSourceIPHashBalancer(t *testing.T) {
+	b := NewSourceIPHashBalancer()
+	loops := loopStats(0, 0, 0, 0, 0)
+	seen := make(map[int]bool)
+	for i := 1; i <= 50; i++ {
+		ip := net.IPv4(10, 0, 0, byte(i)).String()
+		first := b.Pick(tcpInfo(ip, 1000), loops)
+		if first < 0 || first >= len(loops) {
+			t.Fatalf("pick = %d out of range", first)
+		}
+		seen[first] = true
+		// 同一个ip换了端口, 或者v4映射成v6, 还是同一个loop
+		if got := b.Pick(tcpInfo(ip, 2000+i), loops); got != first {
+			t.Fatalf("%s: pick = %d, first = %d", ip, got, first)
+		}
+		if got := b.Pick(tcpInfo("::ffff:"+ip, 3000), loops); got != first {
+			t.Fatalf("v4 mapped %s: pick = %d, first = %d", ip, got, first)
+		}
+	}
+	if len(seen) < 2 {
+		t.Fatalf("all ips hashed to %v", seen)
+	}
+	// 不是ip地址时轮流分
+	unix := ConnInfo{RemoteAddr: &net.UnixAddr{Name: "@", Net: "unix"}}
+	for i := 0; i < 7; i++ {
+		if got := b.Pick(unix, loops); got != i%len(loops) {
+			t.Fatalf("unix pick %d = %d", i, got)
+		}
+	}
+}
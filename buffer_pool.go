@@ -0,0 +1,73 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"sync"
+)
+
+// bufferPool 按2的幂分级缓存[]byte, 每一级一个sync.Pool
+type bufferPool struct {
+	minShift uint
+	maxShift uint
+	pools    []sync.Pool
+}
+
+func newBufferPool(min, max int) *bufferPool {
+	p := &bufferPool{
+		minShift: shiftOf(min),
+		maxShift: shiftOf(max),
+	}
+	p.pools = make([]sync.Pool, p.maxShift-p.minShift+1)
+	return p
+}
+
+// shiftOf 返回>=size的最小2的幂的指数
+func shiftOf(size int) uint {
+	var shift uint
+	for 1<<shift < size {
+		shift++
+	}
+	return shift
+}
+
+func (p *bufferPool) min() int {
+	return 1 << p.minShift
+}
+
+func (p *bufferPool) max() int {
+	return 1 << p.maxShift
+}
+
+// classSize 把size规整到所在级别的大小, 超出范围时取边界
+func (p *bufferPool) classSize(size int) int {
+	shift := shiftOf(size)
+	if shift < p.minShift {
+		shift = p.minShift
+	}
+	if shift > p.maxShift {
+		shift = p.maxShift
+	}
+	return 1 << shift
+}
+
+func (p *bufferPool) get(size int) []byte {
+	size = p.classSize(size)
+	if v := p.pools[shiftOf(size)-p.minShift].Get(); v != nil {
+		return v.([]byte)[:size]
+	}
+	return make([]byte, size)
+}
+
+// put 只接收本池分出去的大小, 其他的直接丢掉
+func (p *bufferPool) put(b []byte) {
+	size := cap(b)
+	if size == 0 || size != p.classSize(size) || size&(size-1) != 0 {
+		return
+	}
+	p.pools[shiftOf(size)-p.minShift].Put(b[:size])
+}
@@ -0,0 +1,57 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import "testing"
+
+func TestBufferPoolClassSize(t *testing.T) {
+	// 不是2的幂的边界向上取整
+	p := newBufferPool(100, 5000)
+	if p.min() != 128 || p.max() != 8192 {
+		t.Fatalf("min = %d, max = %d", p.min(), p.max())
+	}
+	cases := []struct {
+		size, want int
+	}{
+		{0, 128},
+		{1, 128},
+		{128, 128},
+		{129, 256},
+		{1000, 1024},
+		{1024, 1024},
+		{8191, 8192},
+		{8192, 8192},
+		{8193, 8192},
+		{1 << 20, 8192},
+	}
+	for _, tc := range cases {
+		if got := p.classSize(tc.size); got != tc.want {
+			t.Fatalf("classSize(%d) = %d, want %d", tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestBufferPoolGetPut(t *testing.T) {
+	p := newBufferPool(64, 1024)
+	for _, size := range []int{1, 64, 65, 1000, 4096} {
+		b := p.get(size)
+		want := p.classSize(size)
+		if len(b) != want || cap(b) != want {
+			t.Fatalf("get(%d) len = %d cap = %d, want %d", size, len(b), cap(b), want)
+		}
+		p.put(b[:1])
+	}
+	// 不是本池分出去的大小直接丢掉, 不能被get拿到
+	for _, size := range []int{0, 32, 100, 2048} {
+		p.put(make([]byte, size))
+	}
+	for _, size := range []int{1, 100, 1024} {
+		if b := p.get(size); cap(b) != p.classSize(size) {
+			t.Fatalf("get(%d) cap = %d", size, cap(b))
+		}
+	}
+}
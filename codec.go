@@ -0,0 +1,75 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidMsg = errors.New("invalid msg for codec")
+
+	ErrInvalidFrame = errors.New("invalid frame for codec")
+
+	ErrFrameTooLarge = errors.New("frame too large for codec")
+
+	ErrDecodePanic = errors.New("decode panic for codec")
+)
+
+// msgBytes Encode时msg只接收[]byte和string
+func msgBytes(msg interface{}) ([]byte, error) {
+	switch v := msg.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, ErrInvalidMsg
+}
+
+/**
+ * Codec 负责连接上数据的拆包和封包
+ *
+ * Decode: 从buf里取出一个完整的msg, 数据不够时返回nil, nil且不要消费buf
+ *    返回err时buf里缓存的数据会被丢弃, msg和err一起交给Handle, 一般应在Handle里关闭连接
+ *    Decode panic时按返回ErrDecodePanic处理
+ * Encode: 把msg转成要写到连接上的字节, 给Conn.Send用
+ */
+type Codec interface {
+	Decode(buf *InboundBuffer) (msg interface{}, err error)
+	Encode(msg interface{}) ([]byte, error)
+}
+
+/**
+ * readCodec 把HandleConn.Read适配成Codec, 没有设置Codec时使用
+ * in为上次Decode之后新读到的数据, lastRemain为上次留下的remain
+ * isFinRead为true时丢掉remain, isHandle为false时不调用Handle
+ */
+type readCodec struct {
+	read func(in []byte, lastRemain []byte) (packet interface{}, remain []byte, isFinRead bool, isHandle bool, err error)
+}
+
+func (rc *readCodec) Decode(buf *InboundBuffer) (interface{}, error) {
+	if buf.Len() == buf.remain {
+		return nil, nil
+	}
+	data := buf.Bytes()
+	packet, remain, isFinRead, isHandle, err := rc.read(data[buf.remain:], data[:buf.remain])
+	buf.Reset()
+	if !isFinRead && len(remain) > 0 {
+		buf.write(remain)
+		buf.remain = len(remain)
+	}
+	if !isHandle {
+		return nil, nil
+	}
+	return packet, err
+}
+
+func (rc *readCodec) Encode(msg interface{}) ([]byte, error) {
+	return msgBytes(msg)
+}
@@ -0,0 +1,120 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"bytes"
+)
+
+/**
+ * DelimiterCodec 按分隔符拆包, Decode出来的msg为去掉分隔符的[]byte
+ * MaxLength > 0时, 一帧(不含分隔符)超过它返回ErrFrameTooLarge
+ * Encode在msg后面加上分隔符
+ */
+type DelimiterCodec struct {
+	Delimiter []byte
+	MaxLength int
+}
+
+func NewDelimiterCodec(delimiter []byte, maxLength int) (*DelimiterCodec, error) {
+	if len(delimiter) == 0 || maxLength < 0 {
+		return nil, ErrInvalidFrame
+	}
+	return &DelimiterCodec{
+		Delimiter: append([]byte{}, delimiter...),
+		MaxLength: maxLength,
+	}, nil
+}
+
+func (dc *DelimiterCodec) Decode(buf *InboundBuffer) (interface{}, error) {
+	i := dc.index(buf)
+	if i < 0 {
+		if dc.MaxLength > 0 && buf.Len() > dc.MaxLength+len(dc.Delimiter)-1 {
+			return nil, ErrFrameTooLarge
+		}
+		return nil, nil
+	}
+	if dc.MaxLength > 0 && i > dc.MaxLength {
+		return nil, ErrFrameTooLarge
+	}
+	msg := buf.Next(i)
+	buf.Discard(len(dc.Delimiter))
+	return msg, nil
+}
+
+// index 从上次找过的位置接着找分隔符, 避免一帧被拆成很多次read时重复扫描
+func (dc *DelimiterCodec) index(buf *InboundBuffer) int {
+	data := buf.Bytes()
+	start := buf.scanned - len(dc.Delimiter) + 1
+	if start < 0 {
+		start = 0
+	}
+	if i := bytes.Index(data[start:], dc.Delimiter); i >= 0 {
+		return start + i
+	}
+	buf.scanned = len(data)
+	return -1
+}
+
+func (dc *DelimiterCodec) Encode(msg interface{}) ([]byte, error) {
+	b, err := msgBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	if dc.MaxLength > 0 && len(b) > dc.MaxLength {
+		return nil, ErrFrameTooLarge
+	}
+	out := make([]byte, len(b)+len(dc.Delimiter))
+	copy(out, b)
+	copy(out[len(b):], dc.Delimiter)
+	return out, nil
+}
+
+/**
+ * LineCodec 按行拆包, \n和\r\n都算行尾, Decode出来的msg不含行尾
+ * MaxLength > 0时, 一行(不含行尾)超过它返回ErrFrameTooLarge
+ * Encode在msg后面加上\r\n
+ */
+type LineCodec struct {
+	DelimiterCodec
+}
+
+func NewLineCodec(maxLength int) (*LineCodec, error) {
+	if maxLength < 0 {
+		return nil, ErrInvalidFrame
+	}
+	return &LineCodec{
+		DelimiterCodec{
+			Delimiter: []byte("\r\n"),
+			MaxLength: maxLength,
+		},
+	}, nil
+}
+
+func (lc *LineCodec) Decode(buf *InboundBuffer) (interface{}, error) {
+	data := buf.Bytes()
+	start := buf.scanned
+	i := bytes.IndexByte(data[start:], '\n')
+	if i < 0 {
+		buf.scanned = len(data)
+		if lc.MaxLength > 0 && buf.Len() > lc.MaxLength+1 {
+			return nil, ErrFrameTooLarge
+		}
+		return nil, nil
+	}
+	i += start
+	end := i
+	if end > 0 && data[end-1] == '\r' {
+		end--
+	}
+	if lc.MaxLength > 0 && end > lc.MaxLength {
+		return nil, ErrFrameTooLarge
+	}
+	msg := buf.Next(end)
+	buf.Discard(i + 1 - end)
+	return msg, nil
+}
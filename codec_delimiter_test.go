@@ -0,0 +1,159 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDelimiterCodecDecode(t *testing.T) {
+	long := strings.Repeat("y", 70)
+	runCodecCases(t, []codecCase{
+		{
+			name:  "single byte",
+			codec: &DelimiterCodec{Delimiter: []byte("|")},
+			in:    []byte("a|bb||c"),
+			want:  []string{"a", "bb", ""},
+		},
+		{
+			// 32字节一批时分隔符会被拆到两次write里
+			name:  "delimiter across writes",
+			codec: &DelimiterCodec{Delimiter: []byte("#$#")},
+			in:    []byte(strings.Repeat("x", 30) + "#$#" + long + "#$#"),
+			want:  []string{strings.Repeat("x", 30), long},
+		},
+		{
+			name:  "max length fits",
+			codec: &DelimiterCodec{Delimiter: []byte("##"), MaxLength: 4},
+			in:    []byte("abcd##ab##"),
+			want:  []string{"abcd", "ab"},
+		},
+		{
+			name:  "max length without delimiter",
+			codec: &DelimiterCodec{Delimiter: []byte("##"), MaxLength: 4},
+			in:    []byte("ab##abcde#"),
+			want:  []string{"ab"},
+			err:   ErrFrameTooLarge,
+		},
+		{
+			name:  "max length with delimiter",
+			codec: &DelimiterCodec{Delimiter: []byte("#"), MaxLength: 4},
+			in:    []byte("abcde#"),
+			err:   ErrFrameTooLarge,
+		},
+	})
+}
+
+func TestLineCodecDecode(t *testing.T) {
+	long := strings.Repeat("z", 80)
+	runCodecCases(t, []codecCase{
+		{
+			name:  "lf and crlf",
+			codec: &LineCodec{DelimiterCodec{Delimiter: []byte("\r\n")}},
+			in:    []byte("a\nbb\r\n\r\n\nc"),
+			want:  []string{"a", "bb", "", ""},
+		},
+		{
+			name:  "cr inside line",
+			codec: &LineCodec{DelimiterCodec{Delimiter: []byte("\r\n")}},
+			in:    []byte("x\ry\r\n\r\r\n"),
+			want:  []string{"x\ry", "\r"},
+		},
+		{
+			name:  "long lines",
+			codec: &LineCodec{DelimiterCodec{Delimiter: []byte("\r\n")}},
+			in:    []byte(long + "\r\n" + long + "\n"),
+			want:  []string{long, long},
+		},
+		{
+			name:  "max length with crlf",
+			codec: &LineCodec{DelimiterCodec{Delimiter: []byte("\r\n"), MaxLength: 4}},
+			in:    []byte("abcd\r\nabcd\n"),
+			want:  []string{"abcd", "abcd"},
+		},
+		{
+			name:  "max length without lf",
+			codec: &LineCodec{DelimiterCodec{Delimiter: []byte("\r\n"), MaxLength: 4}},
+			in:    []byte("ab\nabcd\rx"),
+			want:  []string{"ab"},
+			err:   ErrFrameTooLarge,
+		},
+		{
+			name:  "max length with lf",
+			codec: &LineCodec{DelimiterCodec{Delimiter: []byte("\r\n"), MaxLength: 4}},
+			in:    []byte("abcde\n"),
+			err:   ErrFrameTooLarge,
+		},
+	})
+}
+
+// TestDelimiterScannedAfterCompact write把未读数据挪到头部后, scanned仍然是相对未读数据的位置, 接着找不会漏掉分隔符
+func TestDelimiterScannedAfterCompact(t *testing.T) {
+	codecs := []struct {
+		name  string
+		codec Codec
+		delim string
+	}{
+		{"delimiter", &DelimiterCodec{Delimiter: []byte("||")}, "||"},
+		{"line", &LineCodec{DelimiterCodec{Delimiter: []byte("\r\n")}}, "\r\n"},
+	}
+	for _, tc := range codecs {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf InboundBuffer
+			buf.buf = make([]byte, 0, 16)
+			buf.write([]byte("first" + tc.delim + "sec"))
+			msg, err := tc.codec.Decode(&buf)
+			if err != nil || string(msg.([]byte)) != "first" {
+				t.Fatalf("first = %v, %v", msg, err)
+			}
+			if msg, err := tc.codec.Decode(&buf); msg != nil || err != nil {
+				t.Fatalf("partial = %v, %v", msg, err)
+			}
+			if buf.r == 0 || buf.scanned != buf.Len() {
+				t.Fatalf("r = %d, scanned = %d, len = %d", buf.r, buf.scanned, buf.Len())
+			}
+			// 放不下时write先把"sec"挪到头部
+			rest := strings.Repeat("o", 20)
+			buf.write([]byte(rest + tc.delim[:1]))
+			if buf.r != 0 {
+				t.Fatalf("write did not compact, r = %d", buf.r)
+			}
+			if msg, err := tc.codec.Decode(&buf); msg != nil || err != nil {
+				t.Fatalf("half delimiter = %v, %v", msg, err)
+			}
+			buf.write([]byte(tc.delim[1:] + "x"))
+			msg, err = tc.codec.Decode(&buf)
+			if err != nil || msg == nil || string(msg.([]byte)) != "sec"+rest {
+				t.Fatalf("second = %q, %v", msg, err)
+			}
+			if buf.Len() != 1 || buf.scanned != 0 {
+				t.Fatalf("after second len = %d, scanned = %d", buf.Len(), buf.scanned)
+			}
+		})
+	}
+}
+
+func TestDelimiterCodecEncode(t *testing.T) {
+	dc := &DelimiterCodec{Delimiter: []byte("\r\n"), MaxLength: 3}
+	b, err := dc.Encode("abc")
+	if err != nil || string(b) != "abc\r\n" {
+		t.Fatalf("encode = %q, %v", b, err)
+	}
+	if _, err := dc.Encode("abcd"); err != ErrFrameTooLarge {
+		t.Fatalf("large msg err = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if _, err := dc.Encode(1); err != ErrInvalidMsg {
+		t.Fatalf("int msg err = %v, want %v", err, ErrInvalidMsg)
+	}
+	if _, err := NewDelimiterCodec(nil, 0); err != ErrInvalidFrame {
+		t.Fatalf("empty delimiter err = %v, want %v", err, ErrInvalidFrame)
+	}
+	if _, err := NewLineCodec(-1); err != ErrInvalidFrame {
+		t.Fatalf("negative max length err = %v, want %v", err, ErrInvalidFrame)
+	}
+}
@@ -0,0 +1,37 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+// FixedLengthCodec 每帧固定Length个字节, Encode只接收长度正好为Length的msg
+type FixedLengthCodec struct {
+	Length int
+}
+
+func NewFixedLengthCodec(length int) (*FixedLengthCodec, error) {
+	if length <= 0 {
+		return nil, ErrInvalidFrame
+	}
+	return &FixedLengthCodec{Length: length}, nil
+}
+
+func (fc *FixedLengthCodec) Decode(buf *InboundBuffer) (interface{}, error) {
+	if buf.Len() < fc.Length {
+		return nil, nil
+	}
+	return buf.Next(fc.Length), nil
+}
+
+func (fc *FixedLengthCodec) Encode(msg interface{}) ([]byte, error) {
+	b, err := msgBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != fc.Length {
+		return nil, ErrInvalidFrame
+	}
+	return b, nil
+}
@@ -0,0 +1,43 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFixedLengthCodecDecode(t *testing.T) {
+	long := strings.Repeat("f", 40)
+	runCodecCases(t, []codecCase{
+		{
+			name:  "short frames",
+			codec: &FixedLengthCodec{Length: 4},
+			in:    []byte("abcdefghij"),
+			want:  []string{"abcd", "efgh"},
+		},
+		{
+			name:  "frames longer than a chunk",
+			codec: &FixedLengthCodec{Length: 40},
+			in:    []byte(long + long + "f"),
+			want:  []string{long, long},
+		},
+	})
+}
+
+func TestFixedLengthCodecEncode(t *testing.T) {
+	fc := &FixedLengthCodec{Length: 3}
+	if b, err := fc.Encode("abc"); err != nil || string(b) != "abc" {
+		t.Fatalf("encode = %q, %v", b, err)
+	}
+	if _, err := fc.Encode("ab"); err != ErrInvalidFrame {
+		t.Fatalf("short msg err = %v, want %v", err, ErrInvalidFrame)
+	}
+	if _, err := NewFixedLengthCodec(0); err != ErrInvalidFrame {
+		t.Fatalf("zero length err = %v, want %v", err, ErrInvalidFrame)
+	}
+}
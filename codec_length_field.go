@@ -0,0 +1,146 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+/**
+ * LengthFieldCodec 按长度字段拆包
+ *
+ * 一帧的总长度 = LengthFieldOffset + LengthFieldLength + 长度字段的值 + LengthAdjustment
+ * Decode出来的msg为[]byte, 是去掉前InitialBytesToStrip个字节后的帧
+ * MaxFrameLength > 0时, 帧总长度超过它返回ErrFrameTooLarge
+ *
+ * Encode接收[]byte或string, 在msg的第LengthFieldOffset个字节处插入长度字段,
+ * 即msg自己带上长度字段前面的头
+ */
+type LengthFieldCodec struct {
+	ByteOrder           binary.ByteOrder
+	LengthFieldOffset   int
+	LengthFieldLength   int
+	LengthAdjustment    int
+	InitialBytesToStrip int
+	MaxFrameLength      int
+}
+
+// NewLengthFieldCodec lengthFieldLength只能是1, 2, 4, 8, order为nil时用大端
+func NewLengthFieldCodec(order binary.ByteOrder, lengthFieldOffset, lengthFieldLength, lengthAdjustment,
+	initialBytesToStrip, maxFrameLength int) (*LengthFieldCodec, error) {
+	switch lengthFieldLength {
+	case 1, 2, 4, 8:
+	default:
+		return nil, ErrInvalidFrame
+	}
+	if lengthFieldOffset < 0 || initialBytesToStrip < 0 || maxFrameLength < 0 {
+		return nil, ErrInvalidFrame
+	}
+	if order == nil {
+		order = binary.BigEndian
+	}
+	return &LengthFieldCodec{
+		ByteOrder:           order,
+		LengthFieldOffset:   lengthFieldOffset,
+		LengthFieldLength:   lengthFieldLength,
+		LengthAdjustment:    lengthAdjustment,
+		InitialBytesToStrip: initialBytesToStrip,
+		MaxFrameLength:      maxFrameLength,
+	}, nil
+}
+
+func (lc *LengthFieldCodec) Decode(buf *InboundBuffer) (interface{}, error) {
+	headerLen := lc.LengthFieldOffset + lc.LengthFieldLength
+	header := buf.Peek(headerLen)
+	if header == nil {
+		return nil, nil
+	}
+	length, err := lc.getLength(header[lc.LengthFieldOffset:])
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(math.MaxInt32) {
+		return nil, ErrFrameTooLarge
+	}
+	frameLen := int(length) + lc.LengthAdjustment + headerLen
+	if frameLen < headerLen || frameLen < lc.InitialBytesToStrip {
+		return nil, ErrInvalidFrame
+	}
+	if lc.MaxFrameLength > 0 && frameLen > lc.MaxFrameLength {
+		return nil, ErrFrameTooLarge
+	}
+	if buf.Len() < frameLen {
+		return nil, nil
+	}
+	buf.Discard(lc.InitialBytesToStrip)
+	return buf.Next(frameLen - lc.InitialBytesToStrip), nil
+}
+
+func (lc *LengthFieldCodec) Encode(msg interface{}) ([]byte, error) {
+	b, err := msgBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < lc.LengthFieldOffset {
+		return nil, ErrInvalidFrame
+	}
+	frameLen := len(b) + lc.LengthFieldLength
+	if lc.MaxFrameLength > 0 && frameLen > lc.MaxFrameLength {
+		return nil, ErrFrameTooLarge
+	}
+	length := len(b) - lc.LengthFieldOffset - lc.LengthAdjustment
+	if length < 0 {
+		return nil, ErrInvalidFrame
+	}
+	out := make([]byte, frameLen)
+	copy(out, b[:lc.LengthFieldOffset])
+	if err := lc.putLength(out[lc.LengthFieldOffset:], uint64(length)); err != nil {
+		return nil, err
+	}
+	copy(out[lc.LengthFieldOffset+lc.LengthFieldLength:], b[lc.LengthFieldOffset:])
+	return out, nil
+}
+
+func (lc *LengthFieldCodec) getLength(b []byte) (uint64, error) {
+	switch lc.LengthFieldLength {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(lc.ByteOrder.Uint16(b)), nil
+	case 4:
+		return uint64(lc.ByteOrder.Uint32(b)), nil
+	case 8:
+		return lc.ByteOrder.Uint64(b), nil
+	}
+	return 0, ErrInvalidFrame
+}
+
+func (lc *LengthFieldCodec) putLength(b []byte, length uint64) error {
+	switch lc.LengthFieldLength {
+	case 1:
+		if length > math.MaxUint8 {
+			return ErrFrameTooLarge
+		}
+		b[0] = byte(length)
+	case 2:
+		if length > math.MaxUint16 {
+			return ErrFrameTooLarge
+		}
+		lc.ByteOrder.PutUint16(b, uint16(length))
+	case 4:
+		if length > math.MaxUint32 {
+			return ErrFrameTooLarge
+		}
+		lc.ByteOrder.PutUint32(b, uint32(length))
+	case 8:
+		lc.ByteOrder.PutUint64(b, length)
+	default:
+		return ErrInvalidFrame
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestLengthFieldCodecDecode(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 100)
+	runCodecCases(t, []codecCase{
+		{
+			name:  "strip length field",
+			codec: &LengthFieldCodec{ByteOrder: binary.BigEndian, LengthFieldLength: 2, InitialBytesToStrip: 2},
+			in: joinFrames(
+				[]byte{0, 5}, []byte("hello"),
+				[]byte{0, 0},
+				[]byte{0, 100}, body,
+			),
+			want: []string{"hello", "", string(body)},
+		},
+		{
+			name:  "header before length field",
+			codec: &LengthFieldCodec{ByteOrder: binary.LittleEndian, LengthFieldOffset: 2, LengthFieldLength: 4},
+			in: joinFrames(
+				[]byte("MG"), []byte{3, 0, 0, 0}, []byte("abc"),
+				[]byte("MG"), []byte{1, 0, 0, 0}, []byte("d"),
+			),
+			want: []string{"MG\x03\x00\x00\x00abc", "MG\x01\x00\x00\x00d"},
+		},
+		{
+			name:  "length includes header",
+			codec: &LengthFieldCodec{ByteOrder: binary.BigEndian, LengthFieldLength: 2, LengthAdjustment: -2, InitialBytesToStrip: 2},
+			in:    joinFrames([]byte{0, 7}, []byte("hello"), []byte{0, 2}),
+			want:  []string{"hello", ""},
+		},
+		{
+			name:  "max frame length",
+			codec: &LengthFieldCodec{ByteOrder: binary.BigEndian, LengthFieldLength: 1, InitialBytesToStrip: 1, MaxFrameLength: 8},
+			in:    joinFrames([]byte{3}, []byte("abc"), []byte{40}, body[:40]),
+			want:  []string{"abc"},
+			err:   ErrFrameTooLarge,
+		},
+		{
+			name:  "length beyond int32",
+			codec: &LengthFieldCodec{ByteOrder: binary.BigEndian, LengthFieldLength: 8, InitialBytesToStrip: 8},
+			in:    []byte{0, 0, 0, 1, 0, 0, 0, 0, 'a'},
+			err:   ErrFrameTooLarge,
+		},
+		{
+			name:  "negative frame length",
+			codec: &LengthFieldCodec{ByteOrder: binary.BigEndian, LengthFieldLength: 1, LengthAdjustment: -5},
+			in:    []byte{2, 'a', 'b'},
+			err:   ErrInvalidFrame,
+		},
+	})
+}
+
+func TestLengthFieldCodecEncode(t *testing.T) {
+	lc := &LengthFieldCodec{ByteOrder: binary.BigEndian, LengthFieldOffset: 2, LengthFieldLength: 2}
+	msgs := []string{"MGhello", "MG", "MGworld"}
+	var in []byte
+	for _, msg := range msgs {
+		b, err := lc.Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in = append(in, b...)
+	}
+	for _, chunk := range chunkSizes {
+		got, err := decodeChunks(lc, in, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(msgs) {
+			t.Fatalf("chunk=%d: got %d msgs, want %d", chunk, len(got), len(msgs))
+		}
+		for i, msg := range msgs {
+			want := msg[:2] + string([]byte{0, byte(len(msg) - 2)}) + msg[2:]
+			if got[i] != want {
+				t.Fatalf("chunk=%d: msg %d = %q, want %q", chunk, i, got[i], want)
+			}
+		}
+	}
+	if _, err := lc.Encode("M"); err != ErrInvalidFrame {
+		t.Fatalf("short msg err = %v, want %v", err, ErrInvalidFrame)
+	}
+	small := &LengthFieldCodec{ByteOrder: binary.BigEndian, LengthFieldLength: 1, InitialBytesToStrip: 1, MaxFrameLength: 4}
+	if _, err := small.Encode("abcd"); err != ErrFrameTooLarge {
+		t.Fatalf("large msg err = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if _, err := NewLengthFieldCodec(nil, 0, 3, 0, 0, 0); err != ErrInvalidFrame {
+		t.Fatalf("3 byte length field err = %v, want %v", err, ErrInvalidFrame)
+	}
+}
@@ -0,0 +1,83 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// chunkSizes 一个字节一个字节地写, 按32字节写, 一次全部写进去
+var chunkSizes = []int{1, 32, 1 << 20}
+
+type codecCase struct {
+	name  string
+	codec Codec
+	in    []byte
+	want  []string
+	err   error
+}
+
+// decodeChunks 按chunk大小把data分批写进连接的InboundBuffer, 每写一批走一遍decodeInbound
+// deliver只收下msg并马上释放对应的字节, 最后没被释放的字节数要和缓存里剩下的一致
+func decodeChunks(codec Codec, data []byte, chunk int) ([]string, error) {
+	var (
+		msgs     []string
+		firstErr error
+	)
+	c := &conn{s: &server{opts: loadOptions()}, codec: codec}
+	deliver := func(c *conn, msg interface{}, err error, n int) error {
+		c.releaseInbound(n)
+		if err != nil {
+			firstErr = err
+			return nil
+		}
+		msgs = append(msgs, string(msg.([]byte)))
+		return nil
+	}
+	for len(data) > 0 && firstErr == nil {
+		n := chunk
+		if n > len(data) {
+			n = len(data)
+		}
+		c.holdInbound(n)
+		c.inbound.write(data[:n])
+		data = data[n:]
+		decodeInbound(codec, c, deliver)
+	}
+	if pending := int(c.pendingIn); pending != c.inbound.Len() {
+		return msgs, fmt.Errorf("pendingIn = %d, inbound = %d", pending, c.inbound.Len())
+	}
+	return msgs, firstErr
+}
+
+func runCodecCases(t *testing.T, cases []codecCase) {
+	for _, tc := range cases {
+		for _, chunk := range chunkSizes {
+			tc, chunk := tc, chunk
+			t.Run(fmt.Sprintf("%s/chunk=%d", tc.name, chunk), func(t *testing.T) {
+				got, err := decodeChunks(tc.codec, tc.in, chunk)
+				if err != tc.err {
+					t.Fatalf("err = %v, want %v", err, tc.err)
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Fatalf("msgs = %q, want %q", got, tc.want)
+				}
+			})
+		}
+	}
+}
+
+// joinFrames 把多帧拼成一段连续的字节流
+func joinFrames(frames ...[]byte) []byte {
+	var out []byte
+	for _, f := range frames {
+		out = append(out, f...)
+	}
+	return out
+}
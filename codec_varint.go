@@ -0,0 +1,67 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+/**
+ * VarintCodec 每帧前面是varint编码的长度, 和protobuf的delimited流一样
+ * Decode出来的msg为不含长度前缀的[]byte
+ * MaxFrameLength > 0时, 内容长度超过它返回ErrFrameTooLarge
+ */
+type VarintCodec struct {
+	MaxFrameLength int
+}
+
+func NewVarintCodec(maxFrameLength int) (*VarintCodec, error) {
+	if maxFrameLength < 0 {
+		return nil, ErrInvalidFrame
+	}
+	return &VarintCodec{MaxFrameLength: maxFrameLength}, nil
+}
+
+func (vc *VarintCodec) Decode(buf *InboundBuffer) (interface{}, error) {
+	length, n := binary.Uvarint(buf.Bytes())
+	if n == 0 {
+		if buf.Len() >= binary.MaxVarintLen64 {
+			return nil, ErrInvalidFrame
+		}
+		return nil, nil
+	}
+	// 超过10个字节的varint和10个字节还没结束一样是坏数据, 不管数据是分几次到的
+	if n < 0 {
+		return nil, ErrInvalidFrame
+	}
+	if length > uint64(math.MaxInt32) {
+		return nil, ErrFrameTooLarge
+	}
+	if vc.MaxFrameLength > 0 && int(length) > vc.MaxFrameLength {
+		return nil, ErrFrameTooLarge
+	}
+	if buf.Len() < n+int(length) {
+		return nil, nil
+	}
+	buf.Discard(n)
+	return buf.Next(int(length)), nil
+}
+
+func (vc *VarintCodec) Encode(msg interface{}) ([]byte, error) {
+	b, err := msgBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	if vc.MaxFrameLength > 0 && len(b) > vc.MaxFrameLength {
+		return nil, ErrFrameTooLarge
+	}
+	out := make([]byte, binary.MaxVarintLen64+len(b))
+	n := binary.PutUvarint(out, uint64(len(b)))
+	copy(out[n:], b)
+	return out[:n+len(b)], nil
+}
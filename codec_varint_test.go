@@ -0,0 +1,81 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVarintCodecDecode(t *testing.T) {
+	body := bytes.Repeat([]byte("v"), 300)
+	runCodecCases(t, []codecCase{
+		{
+			name:  "one and two byte prefix",
+			codec: &VarintCodec{},
+			in: joinFrames(
+				[]byte{5}, []byte("hello"),
+				[]byte{0},
+				[]byte{0xac, 0x02}, body,
+			),
+			want: []string{"hello", "", string(body)},
+		},
+		{
+			name:  "max frame length",
+			codec: &VarintCodec{MaxFrameLength: 100},
+			in:    joinFrames([]byte{2}, []byte("ok"), []byte{0xac, 0x02}, body),
+			want:  []string{"ok"},
+			err:   ErrFrameTooLarge,
+		},
+		{
+			name:  "length beyond int32",
+			codec: &VarintCodec{},
+			in:    []byte{0x80, 0x80, 0x80, 0x80, 0x10, 'a'},
+			err:   ErrFrameTooLarge,
+		},
+		{
+			name:  "varint overflow",
+			codec: &VarintCodec{},
+			in:    bytes.Repeat([]byte{0xff}, 11),
+			err:   ErrInvalidFrame,
+		},
+	})
+}
+
+func TestVarintCodecEncode(t *testing.T) {
+	vc := &VarintCodec{}
+	msgs := []string{"a", "", string(bytes.Repeat([]byte("e"), 200))}
+	var in []byte
+	for _, msg := range msgs {
+		b, err := vc.Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in = append(in, b...)
+	}
+	for _, chunk := range chunkSizes {
+		got, err := decodeChunks(vc, in, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(msgs) {
+			t.Fatalf("chunk=%d: got %d msgs, want %d", chunk, len(got), len(msgs))
+		}
+		for i := range msgs {
+			if got[i] != msgs[i] {
+				t.Fatalf("chunk=%d: msg %d = %q, want %q", chunk, i, got[i], msgs[i])
+			}
+		}
+	}
+	small := &VarintCodec{MaxFrameLength: 2}
+	if _, err := small.Encode("abc"); err != ErrFrameTooLarge {
+		t.Fatalf("large msg err = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if _, err := NewVarintCodec(-1); err != ErrInvalidFrame {
+		t.Fatalf("negative max length err = %v, want %v", err, ErrInvalidFrame)
+	}
+}
@@ -18,10 +18,12 @@ type ConnManger interface {
 
 type connManager struct {
 	conns          *sync.Map
+	ids            *sync.Map
 	connCount      int64
 	connCache      *sync.Pool
 	inCache        *sync.Pool
 	handleReqCache *sync.Pool
+	packetReqCache *sync.Pool
 }
 
 func (m *connManager) getIn() {
@@ -35,8 +37,9 @@ func (m *connManager) decConnCount() {
 	atomic.AddInt64(&m.connCount, -1)
 }
 
-func (m *connManager) delete(fd int) {
-	m.conns.Delete(fd)
+func (m *connManager) delete(c *conn) {
+	m.conns.Delete(c.fd)
+	m.ids.Delete(c.ID())
 }
 
 func (m *connManager) get(fd int) (*conn, bool) {
@@ -47,8 +50,17 @@ func (m *connManager) get(fd int) (*conn, bool) {
 	return v.(*conn), true
 }
 
-func (m *connManager) add(key int, v Conn) {
-	m.conns.Store(key, v)
+func (m *connManager) add(c *conn) {
+	m.conns.Store(c.fd, c)
+	m.ids.Store(c.ID(), c)
+}
+
+func (m *connManager) getByID(id uint64) (*conn, bool) {
+	v, ok := m.ids.Load(id)
+	if !ok {
+		return nil, ok
+	}
+	return v.(*conn), true
 }
 
 func (m *connManager) Len() int64 {
@@ -57,8 +69,23 @@ func (m *connManager) Len() int64 {
 
 func (m *connManager) CloseAllConn() {
 	m.conns.Range(func(key, value interface{}) bool {
-		conn := value.(Conn)
-		conn.Close()
+		conn := value.(*conn)
+		if conn.ref() {
+			conn.closeWith(ErrServerShutdown)
+			conn.unref()
+		}
 		return true
 	})
 }
+
+func (m *connManager) hasPendingWrite() bool {
+	pending := false
+	m.conns.Range(func(key, value interface{}) bool {
+		c := value.(*conn)
+		c.outMu.Lock()
+		pending = !c.outbound.isEmpty()
+		c.outMu.Unlock()
+		return !pending
+	})
+	return pending
+}
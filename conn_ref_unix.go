@@ -0,0 +1,199 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+/**
+ * connRef HandleConn回调和Server.Conn拿到的Conn, 每次accept新建一个, 记住了这次连接的id
+ * 每次调用都先引用住id对应的那次连接, conn被复用给新连接之后所有调用都返回ErrConnClosed
+ */
+type connRef struct {
+	c  *conn
+	id uint64
+}
+
+func (r connRef) ID() uint64 {
+	return r.id
+}
+
+func (r connRef) Write(b []byte) (int, error) {
+	if !r.c.acquire(r.id) {
+		return 0, ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.Write(b)
+}
+
+func (r connRef) Writev(bs [][]byte) (int, error) {
+	if !r.c.acquire(r.id) {
+		return 0, ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.Writev(bs)
+}
+
+func (r connRef) SendFile(f *os.File, offset, count int64) error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.SendFile(f, offset, count)
+}
+
+func (r connRef) Send(msg interface{}) error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.Send(msg)
+}
+
+/**
+ * AsyncWrite 可以在任意协程调用, 拷贝一份b交给连接所属的loop, 由loop按调用顺序写出去
+ * callback在loop的协程上执行, 不能阻塞, 可以为nil
+ */
+func (r connRef) AsyncWrite(b []byte, callback func(err error)) error {
+	return r.c.asyncWrite(r.id, b, callback)
+}
+
+// Wake 可以在任意协程调用, 在连接所属的loop上调用HandleConn.OnWake
+func (r connRef) Wake() error {
+	return r.c.wake(r.id)
+}
+
+func (r connRef) Close() error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.Close()
+}
+
+func (r connRef) CloseRead() error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.CloseRead()
+}
+
+func (r connRef) CloseWrite() error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.CloseWrite()
+}
+
+func (r connRef) CloseAfterFlush() error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.CloseAfterFlush()
+}
+
+func (r connRef) Abort() error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.Abort()
+}
+
+func (r connRef) LocalAddr() net.Addr {
+	if !r.c.acquire(r.id) {
+		return nil
+	}
+	defer r.c.unref()
+	return r.c.LocalAddr()
+}
+
+func (r connRef) RemoteAddr() net.Addr {
+	if !r.c.acquire(r.id) {
+		return nil
+	}
+	defer r.c.unref()
+	return r.c.RemoteAddr()
+}
+
+func (r connRef) SetDeadline(t time.Time) error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.SetDeadline(t)
+}
+
+func (r connRef) SetReadDeadline(t time.Time) error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.SetReadDeadline(t)
+}
+
+func (r connRef) SetWriteDeadline(t time.Time) error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.SetWriteDeadline(t)
+}
+
+func (r connRef) SetOrdered(ordered bool) {
+	if !r.c.acquire(r.id) {
+		return
+	}
+	defer r.c.unref()
+	r.c.SetOrdered(ordered)
+}
+
+func (r connRef) PauseRead() error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.PauseRead()
+}
+
+func (r connRef) ResumeRead() error {
+	if !r.c.acquire(r.id) {
+		return ErrConnClosed
+	}
+	defer r.c.unref()
+	return r.c.ResumeRead()
+}
+
+func (r connRef) SetContext(ctx interface{}) {
+	if !r.c.acquire(r.id) {
+		return
+	}
+	defer r.c.unref()
+	r.c.SetContext(ctx)
+}
+
+func (r connRef) Context() interface{} {
+	if !r.c.acquire(r.id) {
+		return nil
+	}
+	defer r.c.unref()
+	return r.c.Context()
+}
+
+func (r connRef) isNeedClose() bool {
+	if !r.c.acquire(r.id) {
+		return false
+	}
+	defer r.c.unref()
+	return r.c.isNeedClose()
+}
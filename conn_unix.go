@@ -9,10 +9,11 @@ package tfg
 
 import (
 	"golang.org/x/sys/unix"
+	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 )
 
@@ -24,39 +25,344 @@ const (
 	CONN_NEEE_CLOSED
 )
 
+// 连接半关闭和延迟关闭的状态, 可以同时存在, 都在outMu下修改
+const (
+	// SHUT_READ CloseRead之后不再从连接读数据
+	SHUT_READ uint32 = 1 << iota
+	// SHUT_WRITE CloseWrite之后不再接受写, 发送队列写完后shutdown写方向
+	SHUT_WRITE
+	// SHUT_WRITE_DONE 已经对fd执行了shutdown(SHUT_WR)
+	SHUT_WRITE_DONE
+	// SHUT_CLOSE CloseAfterFlush之后不再接受写, 发送队列写完后关闭连接
+	SHUT_CLOSE
+)
+
+// maxSendfileChunk 单次sendfile最多发送的字节数, linux上一次最多也只能发2G左右
+const maxSendfileChunk = 1 << 30
+
+const (
+	PAUSE_USER uint32 = 1 << iota
+	PAUSE_INBOUND
+	PAUSE_OUTBOUND
+)
+
 type Conn interface {
+	ID() uint64
 	Write(b []byte) (int, error)
+	Writev(bs [][]byte) (int, error)
+	SendFile(f *os.File, offset, count int64) error
+	Send(msg interface{}) error
+	AsyncWrite(b []byte, callback func(err error)) error
+	Wake() error
 	Close() error
+	CloseRead() error
+	CloseWrite() error
+	CloseAfterFlush() error
+	Abort() error
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
 	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetOrdered(ordered bool)
+	PauseRead() error
+	ResumeRead() error
+	SetContext(ctx interface{})
+	Context() interface{}
 	isNeedClose() bool
 }
 
 type conn struct {
+	id             uint64
 	fd             int
 	sa             unix.Sockaddr // remote socket address
 	laddr          net.Addr
 	raddr          net.Addr
 	s              *server
+	handleConn     HandleConn
+	codec          Codec
 	indexPollEvent int
 	status         uint32
-	once           sync.Once
+	outMu          sync.Mutex
+	outbound       outboundBuffer
+	iovs           []unix.Iovec
+	corked         int32
+	shut           uint32
+	readDeadline   int64
+	writeDeadline  int64
+	readTimer      timer
+	writeTimer     timer
+	idleTimer      timer
+	timersStopped  bool
+	lastActive     int64
+	readBufSize    int
+	readShrink     int
+	inbound        InboundBuffer
+	ordered        int32
+	handleMu       sync.Mutex
+	handleQueue    []*handleReq
+	handleRunning  bool
+	pauseMu        sync.Mutex
+	pause          uint32
+	pendingIn      int64
+	handling       int64
+	queued         int64
+	refs           int64
+	closeMu        sync.Mutex
+	closeReason    error
+	ctxMu          sync.Mutex
+	ctx            interface{}
+	// handle 交给HandleConn回调的Conn, 绑定了这次连接的id, conn被复用后旧的handle全部返回ErrConnClosed
+	handle *connRef
+}
+
+func (c *conn) reset() {
+	c.outbound.reset()
+	c.inbound.release()
+	c.handleMu.Lock()
+	c.handleQueue = nil
+	c.handleRunning = false
+	c.handleMu.Unlock()
+	atomic.StoreUint32(&c.pause, 0)
+	atomic.StoreInt32(&c.corked, 0)
+	atomic.StoreUint32(&c.shut, 0)
+	atomic.StoreInt64(&c.pendingIn, 0)
+	atomic.StoreInt64(&c.handling, 0)
+	atomic.StoreInt64(&c.queued, 0)
+	c.closeReason = nil
+	c.SetContext(nil)
+	atomic.StoreInt64(&c.readDeadline, 0)
+	atomic.StoreInt64(&c.writeDeadline, 0)
+	c.readTimer = timer{kind: TIMER_READ, c: c, index: -1}
+	c.writeTimer = timer{kind: TIMER_WRITE, c: c, index: -1}
+	c.idleTimer = timer{kind: TIMER_IDLE, c: c, index: -1}
+	c.timersStopped = false
+	c.active()
+	// 调用前已经换好了id, 最后才放开引用, 拿着旧id的协程acquire不到新连接
+	atomic.StoreInt64(&c.refs, 1)
+}
+
+// SetOrdered 覆盖server的HandleMode, true时这个连接的Handle按到达顺序一个一个执行, HandleInline时不起作用
+func (c *conn) SetOrdered(ordered bool) {
+	c.setOrdered(ordered)
+}
+
+func (c *conn) setOrdered(ordered bool) {
+	var v int32
+	if ordered {
+		v = 1
+	}
+	atomic.StoreInt32(&c.ordered, v)
+}
+
+func (c *conn) isOrdered() bool {
+	return atomic.LoadInt32(&c.ordered) == 1
+}
+
+// SetContext 给连接挂上业务自己的数据, OnClose之后清掉, 不会带到复用这个conn的下一个连接
+func (c *conn) SetContext(ctx interface{}) {
+	c.ctxMu.Lock()
+	c.ctx = ctx
+	c.ctxMu.Unlock()
+}
+
+func (c *conn) Context() interface{} {
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
+	return c.ctx
+}
+
+// PauseRead 不再从这个连接读数据, 直到ResumeRead, 对端继续发送会被tcp流控挡住
+func (c *conn) PauseRead() error {
+	return c.setPause(PAUSE_USER, true)
+}
+
+// ResumeRead 只恢复PauseRead的暂停, 水位线引起的暂停仍然生效
+func (c *conn) ResumeRead() error {
+	return c.setPause(PAUSE_USER, false)
+}
+
+// setPause 任何一个原因暂停时关掉EPOLLIN, 所有原因都解除后再打开
+func (c *conn) setPause(reason uint32, on bool) error {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	old := atomic.LoadUint32(&c.pause)
+	pause := old &^ reason
+	if on {
+		pause = old | reason
+	}
+	if pause == old {
+		return nil
+	}
+	if c.isClosed() {
+		return ErrConnClosed
+	}
+	if (old == 0) != (pause == 0) {
+		if err := c.s.pollEvents[c.indexPollEvent].poll.modRead(c.fd, c.tag(), pause == 0); err != nil {
+			return err
+		}
+	}
+	atomic.StoreUint32(&c.pause, pause)
+	return nil
+}
+
+func (c *conn) isReadPaused() bool {
+	return atomic.LoadUint32(&c.pause) != 0
+}
+
+func (c *conn) isPausedBy(reason uint32) bool {
+	return atomic.LoadUint32(&c.pause)&reason != 0
+}
+
+// holdInbound 读到n个字节还没处理完, 超过高水位暂停读
+func (c *conn) holdInbound(n int) {
+	pending := atomic.AddInt64(&c.pendingIn, int64(n))
+	if high := c.s.opts.ReadHighWatermark; high > 0 && pending >= int64(high) {
+		c.setPause(PAUSE_INBOUND, true)
+	}
+}
+
+// releaseInbound n个字节处理完了, 降到低水位恢复读
+func (c *conn) releaseInbound(n int) {
+	if n <= 0 {
+		return
+	}
+	pending := atomic.AddInt64(&c.pendingIn, -int64(n))
+	if c.isPausedBy(PAUSE_INBOUND) && pending <= int64(c.s.opts.ReadLowWatermark) {
+		c.setPause(PAUSE_INBOUND, false)
+	}
+}
+
+// adaptReadBuffer 只在所属的loop上调用, 读满了buffer就翻倍, 连续两次不到一半就减半
+func (c *conn) adaptReadBuffer(n int) {
+	pool := c.s.bufPool
+	switch {
+	case n >= c.readBufSize:
+		c.readShrink = 0
+		if c.readBufSize < pool.max() {
+			c.readBufSize <<= 1
+		}
+	case n <= c.readBufSize>>1:
+		c.readShrink++
+		if c.readShrink >= 2 && c.readBufSize > pool.min() {
+			c.readBufSize >>= 1
+			c.readShrink = 0
+		}
+	default:
+		c.readShrink = 0
+	}
+}
+
+func (c *conn) active() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
 }
 
 func (c *conn) setConnOpened() {
 	atomic.StoreUint32(&c.status, CONN_OPEN)
 }
 
-func (c *conn) setConnNeedClosed() {
-	atomic.StoreUint32(&c.status, CONN_NEEE_CLOSED)
+// setConnNeedClosed 连接要关了, 等交出去的数据都处理完再关, reason交给OnClose
+func (c *conn) setConnNeedClosed(reason error) {
+	c.closeMu.Lock()
+	if atomic.CompareAndSwapUint32(&c.status, CONN_OPEN, CONN_NEEE_CLOSED) {
+		c.closeReason = reason
+	}
+	c.closeMu.Unlock()
 }
 
-func (c *conn) setConnClosed() {
-	atomic.StoreUint32(&c.status, CONN_CLOSE)
+/**
+ * closeIfIdle 要关的连接上没有还在排队的数据和正在执行的Handle时关闭
+ * 对端正常关闭时Write已经返回成功的数据还要发出去, 和CloseAfterFlush一样等发送队列写完再关
+ */
+func (c *conn) closeIfIdle() {
+	if !c.isNeedClose() || atomic.LoadInt64(&c.queued) != 0 || atomic.LoadInt64(&c.handling) != 0 {
+		return
+	}
+	reason := c.shutReason()
+	if reason == ErrConnPeerClosed {
+		c.outMu.Lock()
+		if !c.isClosed() && !c.outbound.isEmpty() {
+			c.setShut(SHUT_CLOSE)
+			c.outMu.Unlock()
+			return
+		}
+		c.outMu.Unlock()
+	}
+	c.closeWith(reason)
+}
+
+// shutReason 交给OnClose的原因, 没有标记过要关闭时是本端主动关闭
+func (c *conn) shutReason() error {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closeReason != nil {
+		return c.closeReason
+	}
+	return ErrConnLocalClosed
+}
+
+// ref 引用计数已经归零的conn在connCache里等着复用, 不能再引用
+func (c *conn) ref() bool {
+	for {
+		n := atomic.LoadInt64(&c.refs)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&c.refs, n, n+1) {
+			return true
+		}
+	}
+}
+
+// acquire 引用住id对应的这次连接, conn已经被复用给了新连接时返回false
+func (c *conn) acquire(id uint64) bool {
+	if !c.ref() {
+		return false
+	}
+	if c.ID() != id {
+		c.unref()
+		return false
+	}
+	return true
+}
+
+// addRef 调用方已经持有引用时再加一个, 交给worker和Handle的数据各持有一个
+func (c *conn) addRef() {
+	atomic.AddInt64(&c.refs, 1)
+}
+
+/**
+ * unref 连接打开时自己持有一个引用, 关闭时放掉, loop, worker, Handle用完后各自放掉
+ * 最后一个引用放掉之后才关闭fd, conn回到connCache, 之后调用方不能再碰这个conn
+ */
+func (c *conn) unref() {
+	if atomic.AddInt64(&c.refs, -1) == 0 {
+		unix.Close(c.fd)
+		c.s.connManager.connCache.Put(c)
+	}
+}
+
+// markClosed 把状态改成CONN_CLOSE, 已经关闭时返回false, 只有改成功的那次调用执行关闭
+func (c *conn) markClosed() bool {
+	for {
+		status := atomic.LoadUint32(&c.status)
+		if status == CONN_CLOSE {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&c.status, status, CONN_CLOSE) {
+			return true
+		}
+	}
 }
 
 func (c *conn) isNeedClose() bool {
+	if atomic.LoadUint32(&c.status) == CONN_NEEE_CLOSED {
+		return true
+	}
+	return false
+}
+
+func (c *conn) isClosed() bool {
 	if atomic.LoadUint32(&c.status) == CONN_CLOSE {
 		return true
 	}
@@ -65,42 +371,450 @@ func (c *conn) isNeedClose() bool {
 
 func (c *conn) ok() bool { return c != nil && c.fd != 0 }
 
+// tag 注册到epoll时带上的id低32位, 事件里的tag对不上就是fd复用之前的旧事件
+func (c *conn) tag() uint32 {
+	return uint32(c.ID())
+}
+
+// ID server内单调递增, 不会因为fd被复用而重复, conn被复用时会换成新的id
+func (c *conn) ID() uint64 {
+	return atomic.LoadUint64(&c.id)
+}
+
 func (c *conn) Write(b []byte) (int, error) {
 	if b == nil || len(b) == 0 {
 		return 0, ErrInputConnWrite
 	}
-	var n int
-	var err error
-	for {
-		if atomic.LoadUint32(&c.s.isWrite) == AVAILABLEWRITE {
-			n, err = unix.Write(c.fd, b)
+	if d := atomic.LoadInt64(&c.writeDeadline); d > 0 && time.Now().UnixNano() >= d {
+		return 0, ErrConnWriteTimeout
+	}
+	c.outMu.Lock()
+	if c.isClosed() {
+		c.outMu.Unlock()
+		return 0, ErrConnClosed
+	}
+	if c.isShut(SHUT_WRITE | SHUT_CLOSE) {
+		c.outMu.Unlock()
+		return 0, ErrConnWriteClosed
+	}
+	// 前面还有没写完的数据, 直接排队, 保证顺序
+	if !c.outbound.isEmpty() || c.s.opts.Cork {
+		c.queue(b)
+		c.outMu.Unlock()
+		return len(b), nil
+	}
+	n, err := unix.Write(c.fd, b)
+	if err != nil {
+		if err != unix.EAGAIN {
+			c.outMu.Unlock()
+			c.closeWith(&ConnError{Op: "write", Err: err})
+			return 0, err
+		}
+		n = 0
+	}
+	if n > 0 {
+		c.active()
+	}
+	if n < len(b) {
+		c.queue(b[n:])
+	}
+	c.outMu.Unlock()
+	return len(b), nil
+}
+
+// Writev 把多块buffer按顺序用一次writev写出去, 没写完的部分排队, 返回的是所有buffer的总长度
+func (c *conn) Writev(bs [][]byte) (int, error) {
+	total := 0
+	for _, b := range bs {
+		total += len(b)
+	}
+	if total == 0 {
+		return 0, ErrInputConnWrite
+	}
+	if d := atomic.LoadInt64(&c.writeDeadline); d > 0 && time.Now().UnixNano() >= d {
+		return 0, ErrConnWriteTimeout
+	}
+	c.outMu.Lock()
+	if c.isClosed() {
+		c.outMu.Unlock()
+		return 0, ErrConnClosed
+	}
+	if c.isShut(SHUT_WRITE | SHUT_CLOSE) {
+		c.outMu.Unlock()
+		return 0, ErrConnWriteClosed
+	}
+	if !c.outbound.isEmpty() || c.s.opts.Cork {
+		c.queue(bs...)
+		c.outMu.Unlock()
+		return total, nil
+	}
+	var (
+		n   int
+		err error
+	)
+	c.iovs, n, err = writev(c.fd, bs, c.iovs)
+	if err != nil {
+		if err != unix.EAGAIN {
+			c.outMu.Unlock()
+			c.closeWith(&ConnError{Op: "write", Err: err})
+			return 0, err
+		}
+		n = 0
+	}
+	if n > 0 {
+		c.active()
+	}
+	if n < total {
+		c.outbound.pushv(bs, n)
+		c.checkWriteHigh()
+	}
+	c.outMu.Unlock()
+	return total, nil
+}
+
+// queue 持有outMu时调用, 数据进发送队列, cork模式下通知loop这一轮结束时flush
+func (c *conn) queue(bs ...[]byte) {
+	c.outbound.pushv(bs, 0)
+	c.checkWriteHigh()
+	c.markCorked()
+}
+
+func (c *conn) markCorked() {
+	if c.s.opts.Cork && atomic.CompareAndSwapInt32(&c.corked, 0, 1) {
+		c.s.pollEvents[c.indexPollEvent].markDirty(c)
+	}
+}
+
+func (c *conn) checkWriteHigh() {
+	if high := c.s.opts.WriteHighWatermark; high > 0 && c.outbound.len() >= high {
+		c.setPause(PAUSE_OUTBOUND, true)
+	}
+}
+
+// Send 用server的Codec编码msg后写到连接上
+func (c *conn) Send(msg interface{}) error {
+	b, err := c.codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(b)
+	return err
+}
+
+// asyncWrite 只写id对应的那次连接, loop上执行时conn已经被复用就回调ErrConnClosed
+func (c *conn) asyncWrite(id uint64, b []byte, callback func(err error)) error {
+	if len(b) == 0 {
+		return ErrInputConnWrite
+	}
+	if !c.acquire(id) {
+		return ErrConnClosed
+	}
+	defer c.unref()
+	if !c.ok() || c.isClosed() {
+		return ErrConnClosed
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	return c.s.pollEvents[c.indexPollEvent].poll.trigger(func() error {
+		var err error
+		if !c.acquire(id) {
+			err = ErrConnClosed
+		} else {
+			if c.isClosed() {
+				err = ErrConnClosed
+			} else {
+				_, err = c.Write(data)
+			}
+			c.unref()
+		}
+		if callback != nil {
+			callback(err)
+		}
+		return nil
+	})
+}
+
+// wake 只唤醒id对应的那次连接
+func (c *conn) wake(id uint64) error {
+	if !c.acquire(id) {
+		return ErrConnClosed
+	}
+	defer c.unref()
+	if !c.ok() || c.isClosed() {
+		return ErrConnClosed
+	}
+	return c.s.pollEvents[c.indexPollEvent].poll.trigger(func() error {
+		if !c.acquire(id) {
+			return nil
+		}
+		if !c.isClosed() {
+			c.handleConn.OnWake(c.handle)
+		}
+		c.unref()
+		return nil
+	})
+}
+
+// flush 在EPOLLOUT时由所属的pollEvent调用, 把排队的数据尽量写出去
+func (c *conn) flush() error {
+	c.outMu.Lock()
+	if c.isClosed() {
+		c.outMu.Unlock()
+		return ErrConnClosed
+	}
+	if err := c.writeOut(); err != nil {
+		c.outMu.Unlock()
+		c.closeWith(err)
+		return err
+	}
+	if c.isPausedBy(PAUSE_OUTBOUND) && c.outbound.len() <= c.s.opts.WriteLowWatermark {
+		c.setPause(PAUSE_OUTBOUND, false)
+	}
+	closeNow, err := c.shutIfDrained()
+	c.outMu.Unlock()
+	if err != nil {
+		c.closeWith(err)
+		return err
+	}
+	if closeNow {
+		return c.closeWith(c.shutReason())
+	}
+	return nil
+}
+
+// writeOut 持有outMu时调用, 按顺序把队列写到EAGAIN或者写完, 出错时返回*ConnError
+func (c *conn) writeOut() error {
+	for !c.outbound.isEmpty() {
+		if item := c.outbound.frontFile(); item != nil {
+			chunk := item.remain
+			if chunk > maxSendfileChunk {
+				chunk = maxSendfileChunk
+			}
+			offset := item.offset
+			n, err := unix.Sendfile(c.fd, item.fd, &offset, int(chunk))
 			if err != nil {
-				if err == syscall.EAGAIN {
-					c.s.setUnAvailableWrite()
+				if err == unix.EAGAIN {
+					return nil
+				}
+				if err == unix.EINTR {
 					continue
 				}
-				return 0, c.Close()
+				return &ConnError{Op: "sendfile", Err: err}
+			}
+			// 文件比SendFile时说的短, 再发也发不出来
+			if n == 0 {
+				return &ConnError{Op: "sendfile", Err: io.ErrUnexpectedEOF}
+			}
+			c.outbound.sent(int64(n))
+			c.active()
+			continue
+		}
+		var (
+			n   int
+			err error
+		)
+		c.iovs, n, err = writev(c.fd, c.outbound.peek(), c.iovs)
+		if err != nil {
+			if err == unix.EAGAIN {
+				c.outbound.discard(0)
+				return nil
 			}
-			break
+			return &ConnError{Op: "write", Err: err}
 		}
+		c.outbound.discard(n)
+		c.active()
 	}
-	return n, nil
+	return nil
+}
+
+/**
+ * SendFile 用sendfile把f从offset开始的count个字节发出去, count<=0时发到文件末尾
+ * 和Write共用一个发送队列, 前面排队的数据发完才会发文件, 发不完的部分等EPOLLOUT继续
+ * 内部dup了一份fd, 调用返回后f就可以关闭
+ */
+func (c *conn) SendFile(f *os.File, offset, count int64) error {
+	if f == nil || offset < 0 {
+		return ErrInputConnWrite
+	}
+	if count <= 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if count = fi.Size() - offset; count <= 0 {
+			return ErrInputConnWrite
+		}
+	}
+	if d := atomic.LoadInt64(&c.writeDeadline); d > 0 && time.Now().UnixNano() >= d {
+		return ErrConnWriteTimeout
+	}
+	fd, err := unix.Dup(int(f.Fd()))
+	if err != nil {
+		return err
+	}
+	c.outMu.Lock()
+	if c.isClosed() {
+		c.outMu.Unlock()
+		unix.Close(fd)
+		return ErrConnClosed
+	}
+	if c.isShut(SHUT_WRITE | SHUT_CLOSE) {
+		c.outMu.Unlock()
+		unix.Close(fd)
+		return ErrConnWriteClosed
+	}
+	pending := !c.outbound.isEmpty()
+	c.outbound.pushFile(fd, offset, count)
+	if pending || c.s.opts.Cork {
+		c.markCorked()
+		c.outMu.Unlock()
+		return nil
+	}
+	if err := c.writeOut(); err != nil {
+		c.outMu.Unlock()
+		c.closeWith(err)
+		return err
+	}
+	c.outMu.Unlock()
+	return nil
 }
 
 func (c *conn) Close() error {
+	return c.closeWith(ErrConnLocalClosed)
+}
+
+// CloseRead shutdown读方向, 之后不再读数据, 写方向也已经关闭时直接关闭连接
+func (c *conn) CloseRead() error {
+	c.outMu.Lock()
+	if c.isClosed() {
+		c.outMu.Unlock()
+		return ErrConnClosed
+	}
+	if c.isShut(SHUT_READ) {
+		c.outMu.Unlock()
+		return nil
+	}
+	err := unix.Shutdown(c.fd, unix.SHUT_RD)
+	c.setShut(SHUT_READ)
+	closeNow := c.isShut(SHUT_WRITE_DONE)
+	c.outMu.Unlock()
+	if closeNow {
+		return c.closeWith(ErrConnLocalClosed)
+	}
+	return err
+}
+
+// CloseWrite 之后的写都返回ErrConnWriteClosed, 发送队列写完后shutdown写方向, 对端读到EOF, 本端还可以继续读
+func (c *conn) CloseWrite() error {
+	return c.shutAfterFlush(SHUT_WRITE)
+}
+
+// CloseAfterFlush 之后的写都返回ErrConnWriteClosed, 发送队列写完后关闭连接
+func (c *conn) CloseAfterFlush() error {
+	return c.shutAfterFlush(SHUT_CLOSE)
+}
+
+func (c *conn) shutAfterFlush(shut uint32) error {
+	c.outMu.Lock()
+	if c.isClosed() {
+		c.outMu.Unlock()
+		return ErrConnClosed
+	}
+	c.setShut(shut)
+	closeNow, err := c.shutIfDrained()
+	c.outMu.Unlock()
+	if err != nil {
+		c.closeWith(err)
+		return err
+	}
+	if closeNow {
+		return c.closeWith(ErrConnLocalClosed)
+	}
+	return nil
+}
+
+/**
+ * shutIfDrained 持有outMu时调用, 发送队列写完后执行CloseWrite和CloseAfterFlush留下的动作
+ * 返回true时调用方解锁后关闭连接
+ */
+func (c *conn) shutIfDrained() (bool, error) {
+	if !c.outbound.isEmpty() {
+		return false, nil
+	}
+	shut := atomic.LoadUint32(&c.shut)
+	if shut&SHUT_CLOSE != 0 {
+		return true, nil
+	}
+	if shut&SHUT_WRITE != 0 && shut&SHUT_WRITE_DONE == 0 {
+		c.setShut(SHUT_WRITE_DONE)
+		if err := unix.Shutdown(c.fd, unix.SHUT_WR); err != nil {
+			return false, &ConnError{Op: "shutdown", Err: err}
+		}
+		shut |= SHUT_WRITE_DONE
+	}
+	return shut&SHUT_READ != 0 && shut&SHUT_WRITE_DONE != 0, nil
+}
+
+// Abort 丢掉发送队列里的数据, 用SO_LINGER 0关闭连接, 对端收到RST, 本端不进入TIME_WAIT
+func (c *conn) Abort() error {
+	c.outMu.Lock()
+	if c.isClosed() {
+		c.outMu.Unlock()
+		return ErrConnClosed
+	}
+	c.outbound.reset()
+	err := unix.SetsockoptLinger(c.fd, unix.SOL_SOCKET, unix.SO_LINGER, &unix.Linger{Onoff: 1, Linger: 0})
+	c.outMu.Unlock()
+	if cerr := c.closeWith(ErrConnAborted); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// setShut 持有outMu时调用
+func (c *conn) setShut(shut uint32) {
+	atomic.StoreUint32(&c.shut, atomic.LoadUint32(&c.shut)|shut)
+}
+
+func (c *conn) isShut(shut uint32) bool {
+	return atomic.LoadUint32(&c.shut)&shut != 0
+}
+
+/**
+ * closeWith 只执行一次, fd从connManager和poll中摘掉并shutdown后调用OnClose
+ * 已经关闭时返回ErrConnClosed, OnClose里再调用Close也不会重复进来
+ * 持有outMu和pauseMu改状态, 已经过了isClosed检查的写和modRead都做完了才算关闭
+ * fd本身等最后一个引用放掉时才close, 之前fd号不会被新连接拿到, 还在读写的协程不会碰到别的连接
+ */
+func (c *conn) closeWith(reason error) error {
+	c.outMu.Lock()
+	c.pauseMu.Lock()
+	closing := c.markClosed()
+	c.pauseMu.Unlock()
+	if closing {
+		c.outbound.reset()
+	}
+	c.outMu.Unlock()
+	if !closing {
+		return ErrConnClosed
+	}
+	c.s.connManager.delete(c)
+	c.s.poolHandle.dropConnWorker(c.ID())
+	pollEvent := c.s.pollEvents[c.indexPollEvent]
+	pollEvent.stopTimers(c)
+	pollEvent.poll.remove(c.fd)
 	var err error
-	c.once.Do(func() {
-		c.s.connManager.delete(c.fd)
-		pollEvent := c.s.pollEvents[c.indexPollEvent]
-		pollEvent.poll.remove(c.fd)
-		if err = unix.Close(c.fd); err != nil {
-			return
+	// Abort要在close时发RST, 不先发FIN
+	if reason != ErrConnAborted {
+		if err = unix.Shutdown(c.fd, unix.SHUT_RDWR); err == unix.ENOTCONN {
+			err = nil
 		}
-		c.s.connManager.decConnCount()
-		pollEvent.decConnCount()
-		c.setConnClosed()
-		c.s.connManager.connCache.Put(c)
-	})
+	}
+	c.s.connManager.decConnCount()
+	pollEvent.decConnCount()
+	c.handleConn.OnClose(c.handle, reason)
+	c.SetContext(nil)
+	c.unref()
 	return err
 }
 
@@ -119,6 +833,32 @@ func (c *conn) RemoteAddr() net.Addr {
 }
 
 func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline 到期时Handle会收到ErrConnReadTimeout, 随后连接被关闭, 传零值取消
+func (c *conn) SetReadDeadline(t time.Time) error {
+	return c.setDeadline(&c.readDeadline, &c.readTimer, t)
+}
+
+// SetWriteDeadline 到期时还有没写完的数据, Handle会收到ErrConnWriteTimeout, 随后连接被关闭, 传零值取消
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return c.setDeadline(&c.writeDeadline, &c.writeTimer, t)
+}
+
+func (c *conn) setDeadline(deadline *int64, tm *timer, t time.Time) error {
+	if !c.ok() || c.isClosed() {
+		return ErrConnClosed
+	}
+	var when int64
+	if !t.IsZero() {
+		when = t.UnixNano()
+	}
+	atomic.StoreInt64(deadline, when)
+	c.s.pollEvents[c.indexPollEvent].resetTimer(tm, when)
 	return nil
 }
 
@@ -144,6 +884,16 @@ func (c *conn) saToAddr(sa unix.Sockaddr) net.Addr {
 			Port: sa.Port,
 			Zone: zone,
 		}
+	case *unix.SockaddrUnix:
+		// 客户端没有bind时x/sys解析出来是"@", 和net包保持一致用空名字
+		name := sa.Name
+		if name == "@" {
+			name = ""
+		}
+		a = &net.UnixAddr{
+			Name: name,
+			Net:  "unix",
+		}
 	}
 	return a
 }
@@ -10,7 +10,9 @@ package tfg
 
 import (
 	"golang.org/x/sys/unix"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type pollEvent struct {
@@ -18,6 +20,45 @@ type pollEvent struct {
 	connCount int64
 	poll      *poll
 	s         *server
+	timerMu   sync.Mutex
+	timers    timerHeap
+	dirtyMu   sync.Mutex
+	dirty     []dirtyConn
+	pkts      []*packetLoop
+	stats     []LoopStat
+}
+
+// dirtyConn cork模式下这一轮loop有数据排队等flush的连接
+type dirtyConn struct {
+	c  *conn
+	id uint64
+}
+
+// markDirty 第一个dirty连接进来时唤醒loop, 保证其他协程里写的数据也能在下一轮写出去
+func (e *pollEvent) markDirty(c *conn) {
+	e.dirtyMu.Lock()
+	e.dirty = append(e.dirty, dirtyConn{c: c, id: c.ID()})
+	first := len(e.dirty) == 1
+	e.dirtyMu.Unlock()
+	if first {
+		e.poll.wakeup()
+	}
+}
+
+// flushDirty 一轮事件处理完之后把cork住的连接各用一次writev写出去
+func (e *pollEvent) flushDirty() {
+	e.dirtyMu.Lock()
+	dirty := e.dirty
+	e.dirty = nil
+	e.dirtyMu.Unlock()
+	for _, d := range dirty {
+		if !d.c.acquire(d.id) {
+			continue
+		}
+		atomic.StoreInt32(&d.c.corked, 0)
+		d.c.flush()
+		d.c.unref()
+	}
 }
 
 func (e *pollEvent) incConnCount() {
@@ -33,88 +74,272 @@ func (e *pollEvent) run() {
 		e.s.signalShutdown()
 		e.s.wg.Done()
 	}()
-	e.poll.wait(func(fd int, mode int32) error {
+	err := e.poll.wait(func(fd int, tag uint32, mode int32) error {
 		c, _ := e.s.connManager.get(fd)
 		if c == nil {
-			return e.accept(fd)
+			// 同一批事件里的连接可能已经被其他协程关闭了, 只有监听fd才accept
+			ln := e.s.listenerOf(fd)
+			if ln == nil {
+				return nil
+			}
+			if ln.isUDP() {
+				e.packets(fd, mode)
+				return nil
+			}
+			return e.accept(ln)
+		}
+		// 处理事件期间引用住conn, Handle里关闭了连接也不会马上被复用
+		if !c.ref() {
+			return nil
+		}
+		// fd已经关闭并被另一个连接复用, 可能还归别的loop管, 这是旧连接留下的事件
+		if c.indexPollEvent != e.id || c.tag() != tag {
+			c.unref()
+			return nil
 		}
 		if mode == 'r' || mode == 'r'+'w' {
 			e.read(c)
 		}
 		if mode == 'w' || mode == 'r'+'w' {
-			e.write()
+			e.write(c)
 		}
+		c.unref()
 		return nil
-	})
+	}, e.tick)
+	if err != nil && err != ErrClosedPoll {
+		e.s.setErr(err)
+	}
+}
+
+// tick 每次epoll wait返回后flush cork住的连接和udp回包, 执行到期的timer, 返回下一次wait的超时时间
+func (e *pollEvent) tick() int {
+	e.flushDirty()
+	for _, p := range e.pkts {
+		p.flush()
+	}
+	for _, t := range e.expiredTimers(time.Now().UnixNano()) {
+		// 从堆里取出来之后conn可能已经关闭并被复用
+		c := t.c
+		if !c.acquire(t.id) {
+			continue
+		}
+		switch t.kind {
+		case TIMER_READ:
+			e.timeout(c, ErrConnReadTimeout)
+		case TIMER_WRITE:
+			c.outMu.Lock()
+			pending := !c.outbound.isEmpty()
+			c.outMu.Unlock()
+			if pending {
+				e.timeout(c, ErrConnWriteTimeout)
+			}
+		case TIMER_IDLE:
+			e.idle(c)
+		}
+		c.unref()
+	}
+	return e.nextTimeout()
+}
+
+// idle 连接在idleTimeout内没有收发数据就关闭, 否则按最后一次活跃时间重新计时
+func (e *pollEvent) idle(c *conn) {
+	if c.isClosed() {
+		return
+	}
+	when := atomic.LoadInt64(&c.lastActive) + int64(e.s.opts.IdleTimeout)
+	if when > time.Now().UnixNano() {
+		e.resetTimer(&c.idleTimer, when)
+		return
+	}
+	c.closeWith(ErrConnIdleTimeout)
+}
+
+// timeout 把超时错误交给Handle, Handle执行完后关闭连接
+func (e *pollEvent) timeout(c *conn, err error) {
+	if c.isClosed() {
+		return
+	}
+	c.setConnNeedClosed(err)
+	if e.s.dispatch(c, nil, err, 0) != nil {
+		c.closeWith(err)
+	}
 }
 
 func (e *pollEvent) opened(c *conn) {
 	c.setConnOpened()
-	if e.s.handleConn.PreOpen != nil {
-		e.s.handleConn.PreOpen(c)
+	if c.handleConn.PreOpen != nil {
+		c.handleConn.PreOpen(c.handle)
 	}
 }
 
-func (e *pollEvent) write() {
-	e.s.setAvailableWrite()
+// packets udp socket上的事件, 先收再发
+func (e *pollEvent) packets(fd int, mode int32) {
+	for _, p := range e.pkts {
+		if p.fd != fd {
+			continue
+		}
+		if mode == 'r' || mode == 'r'+'w' {
+			p.read()
+		}
+		if mode == 'w' || mode == 'r'+'w' {
+			p.flush()
+		}
+		return
+	}
 }
 
-func (e *pollEvent) accept(fd int) error {
+func (e *pollEvent) write(c *conn) {
+	c.flush()
+}
+
+// accept 共用的listener只有第一个loop在accept, 新连接按LoadBalancer交给目标loop注册, SO_REUSEPORT的listener留在自己的loop
+func (e *pollEvent) accept(ln *listener) error {
 	for {
-		if len(e.s.pollEvents) > 1 {
-			switch e.s.acceptBalance {
-			case RoundRobin:
-				if e.id != int(atomic.LoadInt64(&e.s.connManager.connCount))%e.s.numPollEvent {
-					return nil
-				}
-			case LeastConn:
-				count := atomic.LoadInt64(&e.connCount)
-				for _, event := range e.s.pollEvents {
-					if count > atomic.LoadInt64(&event.connCount) {
-						return nil
-					}
-				}
-			}
+		if e.s.isShutdown() {
+			return nil
 		}
-		nfd, sa, err := unix.Accept(fd)
+		nfd, sa, err := unix.Accept(ln.fd)
 		if err != nil {
-			if err == unix.EAGAIN {
-				return nil
+			switch err {
+			case unix.EAGAIN:
+			case unix.EINTR, unix.ECONNABORTED:
+				// 只是这一个连接出错, 接着accept
+				continue
+			default:
+				// EMFILE, ENFILE这类错误不能让loop退出, 等下一次listener可读再accept
+				e.s.opts.Logger.Printf("accept [fd:%v] [err:%v]", ln.fd, err)
 			}
-			return err
+			return nil
 		}
 		if err := unix.SetNonblock(nfd, true); err != nil {
-			return err
+			e.s.opts.Logger.Printf("set nonblock [fd:%v] [err:%v]", nfd, err)
+			unix.Close(nfd)
+			continue
+		}
+		if err := e.s.opts.SocketOptions.apply(nfd, ln.isTCP()); err != nil {
+			e.s.opts.Logger.Printf("set socket options [fd:%v] [err:%v]", nfd, err)
 		}
 		conn := e.s.connManager.connCache.Get().(*conn)
+		id := atomic.AddUint64(&e.s.nextConnID, 1)
+		atomic.StoreUint64(&conn.id, id)
+		conn.handle = &connRef{c: conn, id: id}
+		conn.reset()
 		conn.fd = nfd
 		conn.sa = sa
-		conn.laddr = e.s.ln.lnaddr
+		conn.laddr = ln.lnaddr
+		conn.handleConn = ln.handleConn
+		conn.codec = ln.codec
 		conn.s = e.s
-		conn.indexPollEvent = e.id
+		conn.readBufSize = e.s.bufPool.classSize(e.s.opts.ReadBufferSize)
+		conn.readShrink = 0
+		conn.setOrdered(e.s.opts.HandleMode == HandleOrdered)
 		conn.raddr = conn.saToAddr(sa)
-		e.s.connManager.add(conn.fd, conn)
-		e.poll.addFd(conn.fd)
-		e.incConnCount()
-		e.s.connManager.incConnCount()
-		e.opened(conn)
+		target := e
+		if ln.loop < 0 && len(e.s.pollEvents) > 1 {
+			target = e.s.pollEvents[e.pick(conn)]
+		}
+		conn.indexPollEvent = target.id
+		// 先记到目标loop上, 后面的连接选loop时能看到
+		target.incConnCount()
+		if target == e {
+			e.register(conn)
+			continue
+		}
+		if err := target.poll.trigger(func() error {
+			target.register(conn)
+			return nil
+		}); err != nil {
+			e.s.opts.Logger.Printf("hand conn to loop [loop:%v] [err:%v]", target.id, err)
+			// 目标loop已经停止, 没有接收这个task, 连接在这里关掉
+			if err == ErrClosedPoll {
+				target.decConnCount()
+				conn.unref()
+			}
+		}
 	}
 	return nil
 }
 
+// pick 调用LoadBalancer选目标loop, 越界时留在当前loop
+func (e *pollEvent) pick(c *conn) int {
+	if len(e.stats) != len(e.s.pollEvents) {
+		e.stats = make([]LoopStat, len(e.s.pollEvents))
+	}
+	for i, l := range e.s.pollEvents {
+		e.stats[i] = LoopStat{ID: l.id, ConnCount: atomic.LoadInt64(&l.connCount)}
+	}
+	i := e.s.balancer.Pick(ConnInfo{LocalAddr: c.laddr, RemoteAddr: c.raddr}, e.stats)
+	if i < 0 || i >= len(e.s.pollEvents) {
+		return e.id
+	}
+	return i
+}
+
+// register 在连接所属的loop上把连接加进connManager和poll, 之后才会有这个fd的事件, 已经在停止时直接关掉
+func (e *pollEvent) register(c *conn) {
+	if e.s.isShutdown() {
+		e.decConnCount()
+		c.unref()
+		return
+	}
+	e.s.connManager.add(c)
+	e.poll.addFd(c.fd, c.tag())
+	e.s.connManager.incConnCount()
+	if e.s.opts.IdleTimeout > 0 {
+		e.resetTimer(&c.idleTimer, time.Now().Add(e.s.opts.IdleTimeout).UnixNano())
+	}
+	e.opened(c)
+}
+
 func (e *pollEvent) read(c *conn) {
 	for {
-		cw := e.s.connManager.inCache.Get().(*connWorker)
-		n, err := unix.Read(c.fd, cw.in)
+		if e.s.isShutdown() || c.isClosed() || c.isReadPaused() || c.isShut(SHUT_READ) {
+			return
+		}
+		buf := e.s.bufPool.get(c.readBufSize)
+		n, err := unix.Read(c.fd, buf)
 		if n == 0 || err != nil {
+			e.s.bufPool.put(buf)
 			if err == unix.EAGAIN {
 				return
 			}
-			c.setConnNeedClosed()
+			if err != nil {
+				c.setConnNeedClosed(&ConnError{Op: "read", Err: err})
+			} else {
+				// 对端关了写方向, 不再读, 交出去的数据处理完, 发送队列写完后再关
+				c.outMu.Lock()
+				c.setShut(SHUT_READ)
+				c.outMu.Unlock()
+				c.setConnNeedClosed(ErrConnPeerClosed)
+			}
+			c.closeIfIdle()
 			return
 		}
+		c.active()
+		c.adaptReadBuffer(n)
+		c.holdInbound(n)
+		if e.s.opts.HandleMode == HandleInline {
+			c.inbound.write(buf[:n])
+			e.s.bufPool.put(buf)
+			decodeInbound(c.codec, c, e.s.handleInline)
+			if c.isClosed() {
+				return
+			}
+			continue
+		}
+		cw := e.s.connManager.inCache.Get().(*connWorker)
+		cw.in = buf
 		cw.conn = c
+		cw.id = c.ID()
 		cw.n = n
-		c.s.poolHandle.handleConn(cw)
+		atomic.AddInt64(&c.s.pendingReads, 1)
+		atomic.AddInt64(&c.queued, 1)
+		c.addRef()
+		if err := c.s.poolHandle.handleConn(cw); err != nil {
+			atomic.AddInt64(&c.s.pendingReads, -1)
+			atomic.AddInt64(&c.queued, -1)
+			c.releaseInbound(n)
+			c.unref()
+		}
 	}
 }
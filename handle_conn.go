@@ -10,6 +10,9 @@ type HandleConn interface {
 	PreOpen(c Conn)
 	Read(in []byte, lastRemain []byte) (packet interface{}, remain []byte, isFinRead bool, isHandle bool, err error)
 	Handle(conn Conn, packet interface{}, err error)
+	OnShutdown(c Conn)
+	OnClose(c Conn, reason error)
+	OnWake(c Conn)
 }
 
 type BaseHandleConn struct {
@@ -24,10 +27,52 @@ func (hc *BaseHandleConn) Read(in []byte, lastRemain []byte) (packet interface{}
 }
 
 type handleReq struct {
-	conn   Conn
+	conn   *conn
 	packet interface{}
 	err    error
+	// n 这个packet占用的读入字节数, Handle执行完后释放
+	n int
 }
 
 func (hc *BaseHandleConn) Handle(conn Conn, packet interface{}, err error) {
 }
+
+/**
+ * Shutdown时, 正在处理的数据都处理完后每个连接调用一次, 之后还会把此时写的数据发完再关闭连接
+ */
+func (hc *BaseHandleConn) OnShutdown(c Conn) {
+}
+
+/**
+ * 每个连接只调用一次, 此时fd已经从connManager和poll中摘掉并shutdown, 不能再读写
+ * reason: ErrConnPeerClosed => 对端关闭, 发送队列里的数据已经写完    *ConnError => 读写出错
+ *    ErrConnIdleTimeout, ErrConnReadTimeout, ErrConnWriteTimeout => 超时
+ *    ErrServerShutdown => server停止    ErrConnLocalClosed => 调用了Close, CloseAfterFlush, 或者读写两个方向都关闭了
+ *    ErrConnAborted => 调用了Abort
+ */
+func (hc *BaseHandleConn) OnClose(c Conn, reason error) {
+}
+
+/**
+ * Conn.Wake之后在连接所属的loop协程上调用, 不能阻塞
+ */
+func (hc *BaseHandleConn) OnWake(c Conn) {
+}
+
+/**
+ * PacketHandler udp://地址的server要求HandleConn实现这个接口, 每个数据报调用一次HandlePacket, 不经过Codec和Handle
+ * packet在HandlePacket返回后会被复用, 要保留时自己拷贝, c可以保留下来之后再回包
+ */
+type PacketHandler interface {
+	HandlePacket(c PacketConn, packet []byte)
+}
+
+// ConnError 连接读写出错导致关闭时, 作为OnClose的reason
+type ConnError struct {
+	Op  string
+	Err error
+}
+
+func (e *ConnError) Error() string {
+	return e.Op + " err for conn: " + e.Err.Error()
+}
@@ -0,0 +1,91 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+/**
+ * InboundBuffer 连接上读到还没被Decode消费的数据, 由框架负责累积
+ * 同一个连接的Decode不会并发执行, Bytes和Peek返回的切片只在本次Decode内有效,
+ * 需要交给Handle的数据用Next拿一份拷贝
+ */
+type InboundBuffer struct {
+	buf []byte
+	r   int
+	// remain Read适配器上一次留下的remain长度
+	remain int
+	// scanned 按分隔符拆包时已经找过的长度, 下次从这里接着找
+	scanned int
+}
+
+func (b *InboundBuffer) Len() int {
+	return len(b.buf) - b.r
+}
+
+// Bytes 所有未读的数据, 不消费
+func (b *InboundBuffer) Bytes() []byte {
+	return b.buf[b.r:]
+}
+
+// Peek 前n个字节, 不消费, 数据不够时返回nil
+func (b *InboundBuffer) Peek(n int) []byte {
+	if n < 0 || b.Len() < n {
+		return nil
+	}
+	return b.buf[b.r : b.r+n]
+}
+
+// Next 消费前n个字节并返回一份拷贝, 数据不够时返回nil
+func (b *InboundBuffer) Next(n int) []byte {
+	if n < 0 || b.Len() < n {
+		return nil
+	}
+	out := make([]byte, n)
+	copy(out, b.buf[b.r:b.r+n])
+	b.Discard(n)
+	return out
+}
+
+// Discard 丢掉前n个字节, 返回实际丢掉的个数
+func (b *InboundBuffer) Discard(n int) int {
+	if n > b.Len() {
+		n = b.Len()
+	}
+	if n <= 0 {
+		return 0
+	}
+	b.r += n
+	b.scanned = 0
+	if b.r == len(b.buf) {
+		b.buf = b.buf[:0]
+		b.r = 0
+	}
+	return n
+}
+
+func (b *InboundBuffer) Reset() {
+	b.buf = b.buf[:0]
+	b.r = 0
+	b.remain = 0
+	b.scanned = 0
+}
+
+// write 追加新读到的数据, 空间不够时先把未读的数据挪到头部
+func (b *InboundBuffer) write(p []byte) {
+	if b.r > 0 && len(b.buf)+len(p) > cap(b.buf) {
+		n := copy(b.buf, b.buf[b.r:])
+		b.buf = b.buf[:n]
+		b.r = 0
+	}
+	b.buf = append(b.buf, p...)
+}
+
+// release 连接关闭时释放底层内存
+func (b *InboundBuffer) release() {
+	b.buf = nil
+	b.r = 0
+	b.remain = 0
+	b.scanned = 0
+}
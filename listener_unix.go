@@ -9,23 +9,170 @@
 package tfg
 
 import (
+	"context"
 	"golang.org/x/sys/unix"
+	"io"
 	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type listener struct {
-	ln     net.Listener
-	fd     int
-	lnaddr net.Addr
-	s      *server
+	ln      net.Listener
+	pc      net.PacketConn
+	f       *os.File // 持有fd, 必须一直引用着, 被GC时finalizer会关掉fd
+	fd      int
+	lnaddr  net.Addr
+	network string
+	s       *server
+	// handleConn codec 从这个listener进来的连接和数据报用的
+	handleConn HandleConn
+	codec      Codec
+	// loop SO_REUSEPORT时这个listener只注册在id为loop的pollEvent上, -1表示共用, 见onLoop
+	loop int
 }
 
-func (l *listener) ok() bool { return l != nil && l.ln != nil }
+/**
+ * parseAddr 不带前缀时是tcp, 支持 tcp:// tcp4:// tcp6:// unix:// udp:// udp4:// udp6://
+ * unix:///run/app.sock => 文件路径    unix://@name => linux抽象socket, 不在文件系统上
+ */
+func parseAddr(addr string) (network, address string) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return "tcp", addr
+	}
+	return addr[:i], addr[i+3:]
+}
+
+/**
+ * listen 监听后取出fd交给poll, unix socket会先清理上次没删掉的socket文件
+ * reusePort为true时设置SO_REUSEPORT, 同一个地址可以监听多次, 由内核在这些socket之间分配
+ */
+func listen(network, address string, opts *Options, reusePort bool) (*listener, error) {
+	isPath := network == "unix" && !strings.HasPrefix(address, "@")
+	if isPath {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	var (
+		ln     net.Listener
+		pc     net.PacketConn
+		closer io.Closer
+		laddr  net.Addr
+		err    error
+		lc     net.ListenConfig
+	)
+	if reusePort {
+		lc.Control = controlReusePort
+	}
+	if isUDP(network) {
+		if pc, err = lc.ListenPacket(context.Background(), network, address); err != nil {
+			return nil, err
+		}
+		closer, laddr = pc, pc.LocalAddr()
+	} else {
+		if ln, err = lc.Listen(context.Background(), network, address); err != nil {
+			return nil, err
+		}
+		closer, laddr = ln, ln.Addr()
+	}
+	if isPath && opts.UnixSocketMode != 0 {
+		if err := os.Chmod(address, opts.UnixSocketMode); err != nil {
+			closer.Close()
+			return nil, err
+		}
+	}
+	fl, ok := closer.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		closer.Close()
+		return nil, unix.EINVAL
+	}
+	lnFile, err := fl.File()
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	return &listener{
+		ln:      ln,
+		pc:      pc,
+		f:       lnFile,
+		fd:      int(lnFile.Fd()),
+		lnaddr:  laddr,
+		network: network,
+		loop:    -1,
+	}, nil
+}
+
+func controlReusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// removeStaleSocket path是socket文件且已经没有进程在监听时删掉, 还有进程在监听时交给Listen报地址被占用
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		c.Close()
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func isUDP(network string) bool {
+	return strings.HasPrefix(network, "udp")
+}
+
+func (l *listener) isTCP() bool {
+	return strings.HasPrefix(l.network, "tcp")
+}
+
+func (l *listener) isUDP() bool {
+	return isUDP(l.network)
+}
+
+/**
+ * onLoop 这个listener要不要注册在id为loop的pollEvent上
+ * 共用的tcp和unix listener只注册在第一个loop上, 由它accept后交给LoadBalancer选的loop, 共用的udp socket所有loop一起收
+ */
+func (l *listener) onLoop(loop int) bool {
+	if l.loop >= 0 {
+		return l.loop == loop
+	}
+	return l.isUDP() || loop == 0
+}
+
+func (l *listener) ok() bool { return l != nil && (l.ln != nil || l.pc != nil) }
 
 func (l *listener) Close() error {
 	if !l.ok() {
 		return unix.EINVAL
 	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	if l.pc != nil {
+		return l.pc.Close()
+	}
 	if err := l.ln.Close(); err != nil {
 		return err
 	}
@@ -33,5 +180,5 @@ func (l *listener) Close() error {
 }
 
 func (l *listener) Addr() net.Addr {
-	return l.ln.Addr()
+	return l.lnaddr
 }
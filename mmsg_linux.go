@@ -0,0 +1,48 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"golang.org/x/sys/unix"
+	"unsafe"
+)
+
+// mmsghdr 对应linux的struct mmsghdr, n是内核填的这个消息收发的字节数
+type mmsghdr struct {
+	hdr unix.Msghdr
+	n   uint32
+}
+
+// recvmmsg 一次系统调用最多收len(hdrs)个数据报, 没有数据时返回EAGAIN
+func recvmmsg(fd int, hdrs []mmsghdr) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, uintptr(fd), uintptr(unsafe.Pointer(&hdrs[0])),
+			uintptr(len(hdrs)), unix.MSG_DONTWAIT, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(n), nil
+	}
+}
+
+// sendmmsg 一次系统调用发送多个数据报, 返回发出去的个数, 第一个就发不出去时才返回错误
+func sendmmsg(fd int, hdrs []mmsghdr) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(fd), uintptr(unsafe.Pointer(&hdrs[0])),
+			uintptr(len(hdrs)), unix.MSG_DONTWAIT, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(n), nil
+	}
+}
@@ -0,0 +1,302 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+type HandleMode int
+
+// ReusePortSteer 打开SO_REUSEPORT后新连接分给哪个loop
+type ReusePortSteer int
+
+const (
+	// SteerKernel 内核默认按四元组hash分配
+	SteerKernel ReusePortSteer = iota
+	// SteerCPU 处理这个连接软中断的cpu对loop个数取模
+	SteerCPU
+	// SteerHash 网卡或者RPS算出的rxhash对loop个数取模, 没有rxhash时都会分到第一个loop
+	SteerHash
+)
+
+const (
+	// HandleConcurrent 同一个连接的多个Handle可能并发执行
+	HandleConcurrent HandleMode = iota
+	// HandleOrdered 同一个连接的Handle按到达顺序串行执行, 不同连接之间仍然并发
+	HandleOrdered
+	// HandleInline 在poll loop的协程上直接Decode和执行Handle, 省掉两次协程切换
+	// Handle里绝对不能阻塞, 否则这个loop上的所有连接都会卡住, 只适合echo, 计数, 查缓存这类很轻的处理
+	HandleInline
+)
+
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type stdLogger struct{}
+
+func (l stdLogger) Printf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// SocketOptions 每个accept到的连接都会设置, 零值表示不设置用系统默认, unix socket不设置NoDelay和KeepAlive
+type SocketOptions struct {
+	NoDelay     bool
+	KeepAlive   time.Duration
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+type Options struct {
+	NumLoops           int
+	ReadBufferSize     int
+	MinReadBufferSize  int
+	MaxReadBufferSize  int
+	HandlePoolSize     int
+	PoolSize           int
+	WorkerExpiry       time.Duration
+	EventBatch         int
+	Logger             Logger
+	AcceptBalance      AcceptBalance
+	SocketOptions      SocketOptions
+	IdleTimeout        time.Duration
+	Codec              Codec
+	HandleMode         HandleMode
+	ReadLowWatermark   int
+	ReadHighWatermark  int
+	WriteLowWatermark  int
+	WriteHighWatermark int
+	Cork               bool
+	UnixSocketMode     os.FileMode
+	UDPBatch           int
+	UDPPacketSize      int
+	Listeners          []ListenerConfig
+	ReusePort          bool
+	ReusePortSteer     ReusePortSteer
+	LoadBalancer       LoadBalancer
+}
+
+// ListenerConfig NewServer的addr之外再监听的地址, HandleConn为nil时用NewServer的HandleConn
+type ListenerConfig struct {
+	Addr       string
+	HandleConn HandleConn
+}
+
+type Option func(opts *Options)
+
+func loadOptions(options ...Option) *Options {
+	opts := &Options{
+		ReadBufferSize:    defaultInLen,
+		MinReadBufferSize: defaultMinInLen,
+		MaxReadBufferSize: defaultMaxInLen,
+		HandlePoolSize:    defaultPoolHandleSize,
+		PoolSize:          defaultPoolSize,
+		EventBatch:        defaultEventBatch,
+		Logger:            stdLogger{},
+		AcceptBalance:     RoundRobin,
+		UDPBatch:          defaultUDPBatch,
+		UDPPacketSize:     defaultUDPPacketSize,
+	}
+	for _, option := range options {
+		option(opts)
+	}
+	if opts.MinReadBufferSize > opts.MaxReadBufferSize {
+		opts.MinReadBufferSize = opts.MaxReadBufferSize
+	}
+	return opts
+}
+
+// WithNumLoops poll loop的个数, <=0时为cpu个数
+func WithNumLoops(n int) Option {
+	return func(opts *Options) {
+		opts.NumLoops = n
+	}
+}
+
+// WithReadBufferSize 新连接read时的初始buffer大小, 之后按每次读到的数据量在min和max之间调整
+func WithReadBufferSize(size int) Option {
+	return func(opts *Options) {
+		if size > 0 {
+			opts.ReadBufferSize = size
+		}
+	}
+}
+
+// WithReadBufferRange 读buffer大小的调整范围, 都会向上取到2的幂, min和max相等时大小固定
+func WithReadBufferRange(min, max int) Option {
+	return func(opts *Options) {
+		if min > 0 && max >= min {
+			opts.MinReadBufferSize = min
+			opts.MaxReadBufferSize = max
+		}
+	}
+}
+
+// WithHandlePoolSize 执行Read的worker最大个数
+func WithHandlePoolSize(size int) Option {
+	return func(opts *Options) {
+		if size > 0 {
+			opts.HandlePoolSize = size
+		}
+	}
+}
+
+// WithPoolSize 执行Handle的协程池最大个数
+func WithPoolSize(size int) Option {
+	return func(opts *Options) {
+		if size > 0 {
+			opts.PoolSize = size
+		}
+	}
+}
+
+// WithWorkerExpiry 两个池里的worker空闲超过expiry就回收, 精度为秒, 不设置时各自用默认值
+func WithWorkerExpiry(expiry time.Duration) Option {
+	return func(opts *Options) {
+		if expiry >= time.Second {
+			opts.WorkerExpiry = expiry
+		}
+	}
+}
+
+// WithEventBatch 每次epoll wait最多取出的事件个数
+func WithEventBatch(n int) Option {
+	return func(opts *Options) {
+		if n > 0 {
+			opts.EventBatch = n
+		}
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(opts *Options) {
+		if logger != nil {
+			opts.Logger = logger
+		}
+	}
+}
+
+// WithAcceptBalance 用内置的LoadBalancer分配新连接, 设置了WithLoadBalancer时不起作用
+func WithAcceptBalance(acceptBalance AcceptBalance) Option {
+	return func(opts *Options) {
+		opts.AcceptBalance = acceptBalance
+	}
+}
+
+func WithSocketOptions(socketOptions SocketOptions) Option {
+	return func(opts *Options) {
+		opts.SocketOptions = socketOptions
+	}
+}
+
+// WithIdleTimeout 连接超过d没有收发数据会被关闭, 0表示不限制
+func WithIdleTimeout(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.IdleTimeout = d
+	}
+}
+
+// WithCodec 设置后用Codec拆包, 不再调用HandleConn.Read
+func WithCodec(codec Codec) Option {
+	return func(opts *Options) {
+		opts.Codec = codec
+	}
+}
+
+// WithHandleMode 所有连接默认的Handle执行方式, 单个连接可以用Conn.SetOrdered覆盖, HandleInline时SetOrdered不起作用
+func WithHandleMode(mode HandleMode) Option {
+	return func(opts *Options) {
+		opts.HandleMode = mode
+	}
+}
+
+/**
+ * WithReadWatermarks 连接上读到还没Handle完的字节数达到high时暂停读, 降到low以下恢复
+ * high为0表示不限制
+ */
+func WithReadWatermarks(low, high int) Option {
+	return func(opts *Options) {
+		if low >= 0 && high >= low {
+			opts.ReadLowWatermark = low
+			opts.ReadHighWatermark = high
+		}
+	}
+}
+
+/**
+ * WithWriteWatermarks 连接上还没写出去的字节数达到high时暂停读, 写到low以下恢复
+ * high为0表示不限制
+ */
+func WithWriteWatermarks(low, high int) Option {
+	return func(opts *Options) {
+		if low >= 0 && high >= low {
+			opts.WriteLowWatermark = low
+			opts.WriteHighWatermark = high
+		}
+	}
+}
+
+/**
+ * WithCork 打开后Write和Writev只把数据放进连接的发送队列, 由loop在这一轮事件处理完后用一次writev写出去
+ * 一次Handle里多次写的小包会合并成一个系统调用, 代价是每次写都要多等一次loop唤醒
+ */
+func WithCork(cork bool) Option {
+	return func(opts *Options) {
+		opts.Cork = cork
+	}
+}
+
+// WithUnixSocketMode 监听unix socket文件后chmod成mode, 抽象socket不起作用
+func WithUnixSocketMode(mode os.FileMode) Option {
+	return func(opts *Options) {
+		opts.UnixSocketMode = mode
+	}
+}
+
+/**
+ * WithUDPBatch 每次recvmmsg和sendmmsg最多收发batch个数据报, 每个数据报最大packetSize字节
+ * 超过packetSize的数据报会被丢掉, 每个loop常驻batch*packetSize的接收buffer
+ */
+func WithUDPBatch(batch, packetSize int) Option {
+	return func(opts *Options) {
+		if batch > 0 && packetSize > 0 {
+			opts.UDPBatch = batch
+			opts.UDPPacketSize = packetSize
+		}
+	}
+}
+
+/**
+ * WithListener 再监听一个地址, 和NewServer的addr共用同一组loop和协程池, 可以调用多次
+ * handleConn为nil时用NewServer的HandleConn, 没有设置Codec时按各自HandleConn的Read拆包
+ */
+func WithListener(addr string, handleConn HandleConn) Option {
+	return func(opts *Options) {
+		opts.Listeners = append(opts.Listeners, ListenerConfig{Addr: addr, HandleConn: handleConn})
+	}
+}
+
+/**
+ * WithReusePort 每个loop对tcp和udp地址各自监听一个SO_REUSEPORT的socket, 由内核分配新连接, loop之间不再抢accept
+ * 此时AcceptBalance和LoadBalancer不起作用, steer不是SteerKernel时挂一个cBPF程序按cpu或者rxhash选loop, unix socket仍然所有loop共用一个
+ */
+func WithReusePort(steer ReusePortSteer) Option {
+	return func(opts *Options) {
+		opts.ReusePort = true
+		opts.ReusePortSteer = steer
+	}
+}
+
+// WithLoadBalancer 自定义新连接分给哪个loop
+func WithLoadBalancer(lb LoadBalancer) Option {
+	return func(opts *Options) {
+		opts.LoadBalancer = lb
+	}
+}
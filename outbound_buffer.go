@@ -0,0 +1,130 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import "golang.org/x/sys/unix"
+
+// outboundItem 一块内存数据, 或者file为true时一段还没发完的文件
+type outboundItem struct {
+	buf    []byte
+	file   bool
+	fd     int
+	offset int64
+	remain int64
+}
+
+// outboundBuffer 连接上还没写出去的数据, 按写入顺序排队
+type outboundBuffer struct {
+	items []outboundItem
+	// n 排队中的内存字节数, 文件段不占内存不算在内
+	n    int
+	bufs [][]byte
+}
+
+func (b *outboundBuffer) len() int {
+	return b.n
+}
+
+func (b *outboundBuffer) isEmpty() bool {
+	return len(b.items) == 0
+}
+
+// push 会拷贝一份p, 调用方可以继续复用p
+func (b *outboundBuffer) push(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	b.items = append(b.items, outboundItem{buf: buf})
+	b.n += len(buf)
+}
+
+// pushv 跳过bufs前面已经写出去的skip个字节, 剩下的拷贝后排队
+func (b *outboundBuffer) pushv(bufs [][]byte, skip int) {
+	for _, p := range bufs {
+		if skip >= len(p) {
+			skip -= len(p)
+			continue
+		}
+		b.push(p[skip:])
+		skip = 0
+	}
+}
+
+// pushFile fd归outboundBuffer所有, 发完或者reset时关闭
+func (b *outboundBuffer) pushFile(fd int, offset, count int64) {
+	b.items = append(b.items, outboundItem{file: true, fd: fd, offset: offset, remain: count})
+}
+
+// frontFile 队头是文件段时返回它, sendfile之后用sent更新
+func (b *outboundBuffer) frontFile() *outboundItem {
+	if len(b.items) == 0 || !b.items[0].file {
+		return nil
+	}
+	return &b.items[0]
+}
+
+// sent 队头文件段发出去了n个字节, 发完就关闭fd出队
+func (b *outboundBuffer) sent(n int64) {
+	item := &b.items[0]
+	item.offset += n
+	item.remain -= n
+	if item.remain <= 0 {
+		unix.Close(item.fd)
+		b.pop()
+	}
+}
+
+// peek 队头开始连续的内存数据, 遇到文件段为止, 只能在discard之前使用
+func (b *outboundBuffer) peek() [][]byte {
+	b.bufs = b.bufs[:0]
+	for i := range b.items {
+		if b.items[i].file {
+			break
+		}
+		b.bufs = append(b.bufs, b.items[i].buf)
+	}
+	return b.bufs
+}
+
+func (b *outboundBuffer) discard(n int) {
+	for i := range b.bufs {
+		b.bufs[i] = nil
+	}
+	for n > 0 && len(b.items) > 0 && !b.items[0].file {
+		buf := b.items[0].buf
+		if n < len(buf) {
+			b.items[0].buf = buf[n:]
+			b.n -= n
+			return
+		}
+		n -= len(buf)
+		b.n -= len(buf)
+		b.pop()
+	}
+}
+
+func (b *outboundBuffer) pop() {
+	b.items[0] = outboundItem{}
+	b.items = b.items[1:]
+}
+
+func (b *outboundBuffer) reset() {
+	for i := range b.items {
+		if b.items[i].file {
+			unix.Close(b.items[i].fd)
+		}
+		b.items[i] = outboundItem{}
+	}
+	b.items = b.items[:0]
+	for i := range b.bufs {
+		b.bufs[i] = nil
+	}
+	b.bufs = b.bufs[:0]
+	b.n = 0
+}
@@ -0,0 +1,176 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func peekString(b *outboundBuffer) []string {
+	var out []string
+	for _, p := range b.peek() {
+		out = append(out, string(p))
+	}
+	return out
+}
+
+func TestOutboundBufferPushv(t *testing.T) {
+	cases := []struct {
+		name string
+		bufs []string
+		skip int
+		want []string
+	}{
+		{"no skip", []string{"ab", "cde"}, 0, []string{"ab", "cde"}},
+		{"skip inside first", []string{"ab", "cde"}, 1, []string{"b", "cde"}},
+		{"skip whole first", []string{"ab", "cde"}, 2, []string{"cde"}},
+		{"skip across bufs", []string{"ab", "", "cde", "f"}, 3, []string{"de", "f"}},
+		{"skip all", []string{"ab", "cde"}, 5, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var bufs [][]byte
+			total := 0
+			for _, s := range tc.bufs {
+				bufs = append(bufs, []byte(s))
+				total += len(s)
+			}
+			var b outboundBuffer
+			b.pushv(bufs, tc.skip)
+			// pushv要拷贝, 调用方改自己的buffer不影响排队的数据
+			for _, p := range bufs {
+				for i := range p {
+					p[i] = 'x'
+				}
+			}
+			if got := peekString(&b); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("peek = %q, want %q", got, tc.want)
+			}
+			if b.len() != total-tc.skip || b.isEmpty() != (tc.want == nil) {
+				t.Fatalf("len = %d, empty = %v", b.len(), b.isEmpty())
+			}
+		})
+	}
+}
+
+func TestOutboundBufferDiscard(t *testing.T) {
+	var b outboundBuffer
+	b.push([]byte("abc"))
+	b.push([]byte("de"))
+	b.push([]byte("fghi"))
+	steps := []struct {
+		n    int
+		want []string
+	}{
+		// 只写出去一部分, 队头剩下的下次接着写
+		{1, []string{"bc", "de", "fghi"}},
+		{2, []string{"de", "fghi"}},
+		// 一次写出去跨了几块
+		{3, []string{"ghi"}},
+		{0, []string{"ghi"}},
+		{3, nil},
+	}
+	for i, step := range steps {
+		before := b.len()
+		b.peek()
+		b.discard(step.n)
+		if got := peekString(&b); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("step %d: peek = %q, want %q", i, got, step.want)
+		}
+		if b.len() != before-step.n {
+			t.Fatalf("step %d: len = %d, want %d", i, b.len(), before-step.n)
+		}
+	}
+	if !b.isEmpty() {
+		t.Fatal("buffer not empty")
+	}
+}
+
+func TestOutboundBufferReset(t *testing.T) {
+	var b outboundBuffer
+	b.push([]byte("abc"))
+	b.peek()
+	b.reset()
+	if !b.isEmpty() || b.len() != 0 || len(b.peek()) != 0 {
+		t.Fatalf("after reset len = %d, items = %d", b.len(), len(b.items))
+	}
+	b.push([]byte("x"))
+	if got := peekString(&b); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Fatalf("peek = %q", got)
+	}
+}
+
+// dupFd 代替SendFile里dup出来的fd, 交给outboundBuffer后由它关闭
+func dupFd(t *testing.T) int {
+	var p [2]int
+	if err := unix.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(p[1])
+	return p[0]
+}
+
+func fdClosed(fd int) bool {
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	return err == unix.EBADF
+}
+
+func TestOutboundBufferFile(t *testing.T) {
+	var b outboundBuffer
+	fd := dupFd(t)
+	b.push([]byte("head"))
+	b.pushFile(fd, 10, 100)
+	b.push([]byte("tail"))
+	// 文件段不占内存, peek到文件段为止
+	if got := peekString(&b); !reflect.DeepEqual(got, []string{"head"}) || b.len() != 8 {
+		t.Fatalf("peek = %q, len = %d", got, b.len())
+	}
+	if b.frontFile() != nil {
+		t.Fatal("front is not a file")
+	}
+	b.discard(4)
+	item := b.frontFile()
+	if item == nil || item.fd != fd || item.offset != 10 || item.remain != 100 {
+		t.Fatalf("front file = %+v", item)
+	}
+	if len(b.peek()) != 0 {
+		t.Fatal("peek past a file segment")
+	}
+	b.sent(60)
+	if item := b.frontFile(); item == nil || item.offset != 70 || item.remain != 40 || fdClosed(fd) {
+		t.Fatalf("after partial send file = %+v", item)
+	}
+	b.sent(40)
+	if !fdClosed(fd) {
+		t.Fatal("fd not closed after file sent")
+	}
+	if b.frontFile() != nil {
+		t.Fatal("file still queued")
+	}
+	if got := peekString(&b); !reflect.DeepEqual(got, []string{"tail"}) {
+		t.Fatalf("peek = %q", got)
+	}
+}
+
+func TestOutboundBufferResetClosesFiles(t *testing.T) {
+	var b outboundBuffer
+	fd1, fd2 := dupFd(t), dupFd(t)
+	b.pushFile(fd1, 0, 10)
+	b.push([]byte("ab"))
+	b.pushFile(fd2, 0, 10)
+	b.sent(5)
+	b.reset()
+	if !fdClosed(fd1) || !fdClosed(fd2) {
+		t.Fatalf("reset left fds open: %v %v", fdClosed(fd1), fdClosed(fd2))
+	}
+	if !b.isEmpty() || b.len() != 0 {
+		t.Fatalf("after reset len = %d, items = %d", b.len(), len(b.items))
+	}
+}
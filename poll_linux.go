@@ -10,6 +10,7 @@ package tfg
 
 import (
 	"golang.org/x/sys/unix"
+	"sync"
 	"sync/atomic"
 )
 
@@ -18,33 +19,103 @@ const (
 	POLL_CLOSED
 )
 
+// eventfd的计数器加1, 8字节主机字节序(小端), 任何非0值都能唤醒
+var wakeBytes = []byte{1, 0, 0, 0, 0, 0, 0, 0}
+
 type poll struct {
-	fd     int
-	status uint32
+	fd       int
+	batch    int
+	efd      int
+	status   uint32
+	notified int32
+	taskMu   sync.Mutex
+	tasks    []func() error
 }
 
-func mkPoll() (*poll, error) {
+func mkPoll(batch int) (*poll, error) {
 	fd, err := unix.EpollCreate1(0)
 	if err != nil {
 		return nil, err
 	}
+	efd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err := unix.EpollCtl(fd, unix.EPOLL_CTL_ADD, efd,
+		&unix.EpollEvent{Fd: int32(efd),
+			Events: unix.EPOLLIN,
+		},
+	); err != nil {
+		unix.Close(efd)
+		unix.Close(fd)
+		return nil, err
+	}
 	return &poll{
-		fd: fd,
+		fd:    fd,
+		batch: batch,
+		efd:   efd,
 	}, nil
 }
 
+// wakeup 让阻塞在epoll wait上的loop马上返回, 已经通知过还没被处理时不再重复写eventfd
+func (p *poll) wakeup() error {
+	if !atomic.CompareAndSwapInt32(&p.notified, 0, 1) {
+		return nil
+	}
+	if _, err := unix.Write(p.efd, wakeBytes); err != nil && err != unix.EAGAIN {
+		return err
+	}
+	return nil
+}
+
+/**
+ * trigger 把task交给loop所在的协程执行, task返回错误时loop退出
+ * poll已经关闭时不接收task, 返回ErrClosedPoll, 其他错误时task已经排上队, 停止时也会执行
+ */
+func (p *poll) trigger(task func() error) error {
+	p.taskMu.Lock()
+	if atomic.LoadUint32(&p.status) == POLL_CLOSED {
+		p.taskMu.Unlock()
+		return ErrClosedPoll
+	}
+	p.tasks = append(p.tasks, task)
+	p.taskMu.Unlock()
+	return p.wakeup()
+}
+
+func (p *poll) runTasks() error {
+	buf := make([]byte, 8)
+	unix.Read(p.efd, buf)
+	atomic.StoreInt32(&p.notified, 0)
+	p.taskMu.Lock()
+	tasks := p.tasks
+	p.tasks = nil
+	p.taskMu.Unlock()
+	for _, task := range tasks {
+		if err := task(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (p *poll) triggerClose() {
-	atomic.AddUint32(&p.status, POLL_CLOSED)
+	atomic.StoreUint32(&p.status, POLL_CLOSED)
+	p.wakeup()
 }
 
 func (p *poll) close() error {
+	unix.Close(p.efd)
 	return unix.Close(p.fd)
 }
 
-func (p *poll) wait(f func(fd int, mode int32) error) error {
-	events := make([]unix.EpollEvent, 64)
+// wait f的tag是addFd时记在EpollEvent.Pad里的值, 用来认出fd被复用之前的旧事件
+func (p *poll) wait(f func(fd int, tag uint32, mode int32) error, tick func() int) error {
+	events := make([]unix.EpollEvent, p.batch)
+	timeout := tick()
 	for {
-		n, err := unix.EpollWait(p.fd, events, -1)
+		n, err := unix.EpollWait(p.fd, events, timeout)
 		if err != nil && err != unix.EINTR {
 			return err
 		}
@@ -52,6 +123,12 @@ func (p *poll) wait(f func(fd int, mode int32) error) error {
 			return ErrClosedPoll
 		}
 		for i := 0; i < n; i++ {
+			if int(events[i].Fd) == p.efd {
+				if err := p.runTasks(); err != nil {
+					return err
+				}
+				continue
+			}
 			var mode int32
 			if events[i].Events&(unix.EPOLLIN|unix.EPOLLRDHUP|unix.EPOLLHUP|unix.EPOLLERR) != 0 {
 				mode += 'r'
@@ -61,12 +138,13 @@ func (p *poll) wait(f func(fd int, mode int32) error) error {
 			}
 			if mode != 0 {
 				if fd := int(events[i].Fd); fd != 0 {
-					if err := f(fd, mode); err != nil {
+					if err := f(fd, uint32(events[i].Pad), mode); err != nil {
 						return err
 					}
 				}
 			}
 		}
+		timeout = tick()
 	}
 }
 
@@ -80,9 +158,9 @@ func (p *poll) addLn(fd int) {
 	}
 }
 
-func (p *poll) addFd(fd int) {
+func (p *poll) addFd(fd int, tag uint32) {
 	if err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd,
-		&unix.EpollEvent{Fd: int32(fd),
+		&unix.EpollEvent{Fd: int32(fd), Pad: int32(tag),
 			Events: unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLPRI | unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLET,
 		},
 	); err != nil {
@@ -90,6 +168,19 @@ func (p *poll) addFd(fd int) {
 	}
 }
 
+// modRead 打开或关闭fd上的EPOLLIN, 重新打开时有数据epoll会马上再通知一次
+func (p *poll) modRead(fd int, tag uint32, read bool) error {
+	events := uint32(unix.EPOLLOUT | unix.EPOLLPRI | unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLET)
+	if read {
+		events |= unix.EPOLLIN
+	}
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd,
+		&unix.EpollEvent{Fd: int32(fd), Pad: int32(tag),
+			Events: events,
+		},
+	)
+}
+
 func (p *poll) remove(fd int) {
 	if err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, fd, nil); err != nil {
 		panic(err)
@@ -37,7 +37,9 @@ var (
 type PoolHandle struct {
 	s *server
 
-	connWorkers sync.Map
+	connMu sync.Mutex
+
+	connWorkers map[uint64]*connBinding
 
 	capacity int32
 
@@ -53,10 +55,6 @@ type PoolHandle struct {
 
 	cond *sync.Cond
 
-	read func(in []byte, lastRemain []byte) (packet interface{}, remain []byte, isFinRead bool, isHandle bool, err error)
-
-	handle func(conn Conn, packet interface{}, err error)
-
 	once sync.Once
 
 	workerCache sync.Pool
@@ -64,20 +62,67 @@ type PoolHandle struct {
 	PanicHandler func(interface{})
 }
 
-func (p *PoolHandle) getConnWorker(fd int) (*WorkerHandle, bool) {
-	v, ok := p.connWorkers.Load(fd)
-	if !ok {
-		return nil, ok
+// connBinding 连接当前绑定的worker, queued为已经发给worker还没处理完的数据块数, closed为连接已经关闭
+type connBinding struct {
+	worker *WorkerHandle
+	queued int
+	closed bool
+}
+
+// bindConnWorker 只有一个loop会为同一个连接调用, 找不到绑定时新取一个worker
+// 按连接id绑定, fd被内核复用后新连接不会拿到旧连接的worker
+func (p *PoolHandle) bindConnWorker(id uint64) *WorkerHandle {
+	p.connMu.Lock()
+	if b, ok := p.connWorkers[id]; ok {
+		b.queued++
+		p.connMu.Unlock()
+		return b.worker
 	}
-	return v.(*WorkerHandle), true
+	p.connMu.Unlock()
+	worker := p.retrieveWorker()
+	p.connMu.Lock()
+	p.connWorkers[id] = &connBinding{worker: worker, queued: 1}
+	p.connMu.Unlock()
+	return worker
 }
 
-func (p *PoolHandle) storeConnWorker(fd int, workHandle *WorkerHandle) {
-	p.connWorkers.Store(fd, workHandle)
+// unbindConnWorker worker处理完一个数据块后调用, isFinRead且没有排队的数据时解除绑定返回true
+func (p *PoolHandle) unbindConnWorker(id uint64, isFinRead bool) bool {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	b, ok := p.connWorkers[id]
+	if !ok {
+		return true
+	}
+	b.queued--
+	if (!isFinRead && !b.closed) || b.queued > 0 {
+		return false
+	}
+	delete(p.connWorkers, id)
+	return true
 }
 
-func (p *PoolHandle) deleteConnWorker(fd int) {
-	p.connWorkers.Delete(fd)
+/**
+ * dropConnWorker 连接关闭时调用, 留着半个包的连接不会再有数据进来, 不能一直占着worker
+ * 没有排队的数据时马上解除绑定把worker还回去, 否则等最后一块数据处理完再解除
+ */
+func (p *PoolHandle) dropConnWorker(id uint64) {
+	p.connMu.Lock()
+	b, ok := p.connWorkers[id]
+	if !ok {
+		p.connMu.Unlock()
+		return
+	}
+	if b.queued > 0 {
+		b.closed = true
+		p.connMu.Unlock()
+		return
+	}
+	delete(p.connWorkers, id)
+	p.connMu.Unlock()
+	if !p.revertWorker(b.worker) {
+		b.worker.connCh <- nil
+	}
 }
 
 func (p *PoolHandle) periodicallyPurge() {
@@ -111,13 +156,11 @@ func (p *PoolHandle) periodicallyPurge() {
 	}
 }
 
-func NewPoolHandle(size int, read func(in []byte, lastRemain []byte) (packet interface{},
-	remain []byte, isFinRead bool, isHandle bool, err error), handle func(conn Conn, packet interface{}, err error), s *server) (*PoolHandle, error) {
-	return NewTimingPoolHandle(size, defaultPoolHandleCleanIntervalTime, read, handle, s)
+func NewPoolHandle(size int, s *server) (*PoolHandle, error) {
+	return NewTimingPoolHandle(size, defaultPoolHandleCleanIntervalTime, s)
 }
 
-func NewTimingPoolHandle(size, expiry int, read func(in []byte, lastRemain []byte) (packet interface{},
-	remain []byte, isFinRead bool, isHandle bool, err error), handle func(conn Conn, packet interface{}, err error), s *server) (*PoolHandle, error) {
+func NewTimingPoolHandle(size, expiry int, s *server) (*PoolHandle, error) {
 	if size <= 0 {
 		return nil, ErrInvalidPoolSize
 	}
@@ -126,9 +169,8 @@ func NewTimingPoolHandle(size, expiry int, read func(in []byte, lastRemain []byt
 	}
 	p := &PoolHandle{
 		capacity:       int32(size),
+		connWorkers:    make(map[uint64]*connBinding),
 		expiryDuration: time.Duration(expiry) * time.Second,
-		read:           read,
-		handle:         handle,
 		s:              s,
 	}
 	p.cond = sync.NewCond(&p.lock)
@@ -140,13 +182,7 @@ func (p *PoolHandle) handleConn(connWorker *connWorker) error {
 	if CLOSED == atomic.LoadInt32(&p.release) {
 		return ErrPoolClosed
 	}
-	var worker *WorkerHandle
-	var ok bool
-	worker, ok = p.getConnWorker(connWorker.conn.fd)
-	if !ok {
-		worker = p.retrieveWorker(connWorker.conn.fd)
-		p.storeConnWorker(connWorker.conn.fd, worker)
-	}
+	worker := p.bindConnWorker(connWorker.id)
 	worker.connCh <- connWorker
 	return nil
 }
@@ -186,7 +222,7 @@ func (p *PoolHandle) decRunning() {
 	atomic.AddInt32(&p.running, -1)
 }
 
-func (p *PoolHandle) retrieveWorker(fd int) *WorkerHandle {
+func (p *PoolHandle) retrieveWorker() *WorkerHandle {
 	var w *WorkerHandle
 	p.lock.Lock()
 	idleWorkers := p.workers
@@ -7,20 +7,26 @@
 package tfg
 
 import (
+	"context"
 	"errors"
 	"github.com/panjf2000/ants"
 	"math"
 	"net"
+	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Server interface {
 	Start() error
+	Wait() error
 	Stop()
+	Shutdown(ctx context.Context) error
 	Serve() error
 	Listener() net.Listener
 	SetPreServing(func(server Server))
+	Conn(id uint64) (Conn, bool)
 }
 
 type AcceptBalance int
@@ -29,18 +35,37 @@ const (
 	Random AcceptBalance = iota
 	RoundRobin
 	LeastConn
+	SourceIPHash
 )
 
 var (
 	defaultPoolHandleCleanIntervalTime = 1
-	defaultInLen                       = 32
+	defaultInLen                       = 4096
+	defaultMinInLen                    = 512
+	defaultMaxInLen                    = 64 * 1024
 	defaultPoolHandleSize              = math.MaxInt32 / 2
 	defaultPoolSize                    = math.MaxInt32 / 2
 	defaultPoolCleanIntervalTime       = 5
+	defaultEventBatch                  = 64
+	defaultShutdownPollInterval        = 10 * time.Millisecond
+	defaultUDPBatch                    = 32
+	defaultUDPPacketSize               = 8192
 	ErrInputConnWrite                  = errors.New("input err for conn write")
+	ErrConnClosed                      = errors.New("closed for conn")
+	ErrConnReadTimeout                 = errors.New("read timeout for conn")
+	ErrConnWriteTimeout                = errors.New("write timeout for conn")
 	ErrClosedPoll                      = errors.New("closed for poll")
+	ErrServerClosed                    = errors.New("closed for server")
+	ErrServerShutdown                  = errors.New("shutdown for server")
+	ErrConnPeerClosed                  = errors.New("peer closed for conn")
+	ErrConnLocalClosed                 = errors.New("local closed for conn")
+	ErrConnIdleTimeout                 = errors.New("idle timeout for conn")
+	ErrConnWriteClosed                 = errors.New("write closed for conn")
+	ErrConnAborted                     = errors.New("aborted for conn")
+	ErrNoPacketHandler                 = errors.New("handle conn not implement PacketHandler for udp")
 )
 
+// Listener NewServer的addr对应的listener, udp://地址时为nil
 func (s *server) Listener() net.Listener {
 	return s.ln.ln
 }
@@ -49,41 +74,239 @@ func (s *server) SetPreServing(f func(server Server)) {
 	s.preServing = f
 }
 
+/**
+ * Conn 按id找连接, 连接已经关闭时返回false, 其他协程要操作某个连接时应该先用id找
+ * 返回的Conn和回调里拿到的是同一个, 只对应这个id, 连接关闭之后一直返回ErrConnClosed
+ */
+func (s *server) Conn(id uint64) (Conn, bool) {
+	c, ok := s.connManager.getByID(id)
+	if !ok || !c.acquire(id) {
+		return nil, false
+	}
+	defer c.unref()
+	if c.isClosed() {
+		return nil, false
+	}
+	return c.handle, true
+}
+
 type server struct {
 	pool          *ants.PoolWithFunc
 	pollEvents    []*pollEvent
 	wg            sync.WaitGroup
-	cond          *sync.Cond
-	acceptBalance AcceptBalance
+	balancer      LoadBalancer
 	poolHandle    *PoolHandle
 	numPollEvent  int
 	ln            *listener
+	lns           []*listener
 	addr          string
 	preServing    func(server Server)
 	handleConn    HandleConn
-	isWrite       uint32
 	connManager   *connManager
+	opts          *Options
+	bufPool       *bufferPool
+	shutdown      int32
+	pendingReads  int64
+	runningHandle int64
+	nextConnID    uint64
+	stopOnce      sync.Once
+	exit          chan struct{}
+	exitOnce      sync.Once
+	done          chan struct{}
+	err           error
+	errOnce       sync.Once
+}
+
+func (s *server) setErr(err error) {
+	s.errOnce.Do(func() {
+		s.err = err
+	})
+}
+
+func (s *server) isShutdown() bool {
+	return atomic.LoadInt32(&s.shutdown) == 1
+}
+
+// putConnWorker 把读buffer还给bufPool, connWorker还给inCache
+func (s *server) putConnWorker(cw *connWorker) {
+	s.bufPool.put(cw.in)
+	cw.in = nil
+	cw.conn = nil
+	cw.id = 0
+	cw.n = 0
+	s.connManager.inCache.Put(cw)
+}
+
+// dispatch 把msg交给协程池执行Handle, 连接是有序模式时先进连接自己的队列
+func (s *server) dispatch(c *conn, msg interface{}, err error, n int) error {
+	if s.opts.HandleMode == HandleInline {
+		return s.handleInline(c, msg, err, n)
+	}
+	req := s.connManager.handleReqCache.Get().(*handleReq)
+	req.conn = c
+	req.packet = msg
+	req.err = err
+	req.n = n
+	if c.isOrdered() {
+		return s.enqueueHandle(c, req)
+	}
+	if err := s.serveHandle(req); err != nil {
+		c.releaseInbound(req.n)
+		s.connManager.handleReqCache.Put(req)
+		return err
+	}
+	return nil
+}
+
+// enqueueHandle 同一个连接同时只有一个drainHandle在协程池里跑, 按到达顺序执行Handle
+func (s *server) enqueueHandle(c *conn, req *handleReq) error {
+	s.holdHandle(c)
+	c.handleMu.Lock()
+	c.handleQueue = append(c.handleQueue, req)
+	if c.handleRunning {
+		c.handleMu.Unlock()
+		return nil
+	}
+	c.handleRunning = true
+	c.handleMu.Unlock()
+	// drainHandle执行期间也引用住conn
+	c.addRef()
+	if err := s.pool.Serve(c); err != nil {
+		c.handleMu.Lock()
+		queue := c.handleQueue
+		c.handleQueue = nil
+		c.handleRunning = false
+		c.handleMu.Unlock()
+		for _, req := range queue {
+			c.releaseInbound(req.n)
+			s.connManager.handleReqCache.Put(req)
+			s.releaseHandle(c)
+		}
+		c.unref()
+		return err
+	}
+	return nil
+}
+
+func (s *server) drainHandle(c *conn) {
+	defer c.unref()
+	for {
+		c.handleMu.Lock()
+		if len(c.handleQueue) == 0 {
+			c.handleRunning = false
+			c.handleMu.Unlock()
+			return
+		}
+		req := c.handleQueue[0]
+		c.handleQueue[0] = nil
+		c.handleQueue = c.handleQueue[1:]
+		c.handleMu.Unlock()
+		s.runQueuedHandle(req)
+	}
+}
+
+// runQueuedHandle 一个Handle panic了队列里后面的还要接着执行, 否则连接关不掉, Shutdown也一直等
+func (s *server) runQueuedHandle(req *handleReq) {
+	defer func() {
+		if p := recover(); p != nil {
+			s.opts.Logger.Printf("ordered handle exits from a panic: %v", p)
+		}
+	}()
+	s.runHandle(req)
+}
+
+// handleInline HandleInline模式下在loop的协程上直接执行Handle, panic只打日志不让loop退出
+func (s *server) handleInline(c *conn, msg interface{}, err error, n int) error {
+	defer func() {
+		if p := recover(); p != nil {
+			s.opts.Logger.Printf("inline handle exits from a panic: %v", p)
+		}
+	}()
+	req := s.connManager.handleReqCache.Get().(*handleReq)
+	req.conn = c
+	req.packet = msg
+	req.err = err
+	req.n = n
+	s.holdHandle(c)
+	s.runHandle(req)
+	return nil
+}
+
+// runHandle holdHandle时已经引用住了conn, 执行Handle期间conn不会被复用
+func (s *server) runHandle(req *handleReq) {
+	c := req.conn
+	defer func() {
+		c.releaseInbound(req.n)
+		s.connManager.handleReqCache.Put(req)
+		s.releaseHandle(c)
+	}()
+	c.handleConn.Handle(c.handle, req.packet, req.err)
+}
+
+// runPacket 执行完HandlePacket后数据报的buffer还给bufPool
+func (s *server) runPacket(req *packetReq) {
+	defer func() {
+		s.putPacketReq(req)
+		atomic.AddInt64(&s.runningHandle, -1)
+	}()
+	req.c.p.ln.handleConn.(PacketHandler).HandlePacket(req.c, req.buf[:req.n])
+}
+
+func (s *server) handlePacketInline(req *packetReq) {
+	defer func() {
+		if p := recover(); p != nil {
+			s.opts.Logger.Printf("inline handle exits from a panic: %v", p)
+		}
+	}()
+	s.runPacket(req)
+}
+
+func (s *server) putPacketReq(req *packetReq) {
+	s.bufPool.put(req.buf)
+	req.c, req.buf, req.n = nil, nil, 0
+	s.connManager.packetReqCache.Put(req)
+}
+
+// holdHandle 交出去一个Handle, server和连接上都记一下, Shutdown和延迟关闭连接时用
+func (s *server) holdHandle(c *conn) {
+	atomic.AddInt64(&s.runningHandle, 1)
+	atomic.AddInt64(&c.handling, 1)
+	c.addRef()
 }
 
-func (s *server) setAvailableWrite() {
-	atomic.StoreUint32(&s.isWrite, AVAILABLEWRITE)
+// releaseHandle 要关的连接没有其他Handle和数据时关闭, 放掉引用后不能再碰c
+func (s *server) releaseHandle(c *conn) {
+	atomic.AddInt64(&c.handling, -1)
+	atomic.AddInt64(&s.runningHandle, -1)
+	c.closeIfIdle()
+	c.unref()
 }
 
-func (s *server) setUnAvailableWrite() {
-	atomic.StoreUint32(&s.isWrite, UNAVAILABLEWRITE)
+func (s *server) serveHandle(req *handleReq) error {
+	s.holdHandle(req.conn)
+	if err := s.pool.Serve(req); err != nil {
+		s.releaseHandle(req.conn)
+		return err
+	}
+	return nil
 }
 
-func NewServer(addr string, HandleConn HandleConn, numPollEvent int, acceptBalance AcceptBalance) (Server, error) {
+func NewServer(addr string, HandleConn HandleConn, options ...Option) (Server, error) {
+	opts := loadOptions(options...)
 	s := &server{
-		addr:          addr,
-		numPollEvent:  numPollEvent,
-		cond:          sync.NewCond(&sync.Mutex{}),
-		acceptBalance: acceptBalance,
+		addr:         addr,
+		numPollEvent: opts.NumLoops,
+		exit:         make(chan struct{}),
+		done:         make(chan struct{}),
+		balancer:     opts.LoadBalancer,
+		opts:         opts,
+		bufPool:      newBufferPool(opts.MinReadBufferSize, opts.MaxReadBufferSize),
 		connManager: &connManager{
 			conns: &sync.Map{},
+			ids:   &sync.Map{},
 			inCache: &sync.Pool{
 				New: func() interface{} {
-					return &connWorker{in: make([]byte, defaultInLen)}
+					return &connWorker{}
 				},
 			},
 			connCache: &sync.Pool{
@@ -96,24 +319,41 @@ func NewServer(addr string, HandleConn HandleConn, numPollEvent int, acceptBalan
 					return &handleReq{}
 				},
 			},
+			packetReqCache: &sync.Pool{
+				New: func() interface{} {
+					return &packetReq{}
+				},
+			},
 		},
 		handleConn: HandleConn,
 	}
-	pool, err := ants.NewTimingPoolWithFunc(defaultPoolSize, defaultPoolCleanIntervalTime, func(i interface{}) {
-		req := i.(*handleReq)
-		defer func() {
-			if req.conn.isNeedClose() {
-				req.conn.Close()
-			}
-			s.connManager.handleReqCache.Put(req)
-		}()
-		s.handleConn.Handle(req.conn, req.packet, req.err)
+	if s.balancer == nil {
+		s.balancer = NewLoadBalancer(opts.AcceptBalance)
+	}
+	poolExpiry, poolHandleExpiry := defaultPoolCleanIntervalTime, defaultPoolHandleCleanIntervalTime
+	if opts.WorkerExpiry > 0 {
+		poolExpiry = int(opts.WorkerExpiry / time.Second)
+		poolHandleExpiry = poolExpiry
+	}
+	pool, err := ants.NewTimingPoolWithFunc(opts.PoolSize, poolExpiry, func(i interface{}) {
+		switch v := i.(type) {
+		case *handleReq:
+			s.runHandle(v)
+		case *conn:
+			s.drainHandle(v)
+		case *packetReq:
+			s.runPacket(v)
+		}
 	})
 	if err != nil {
 		return nil, err
 	}
+	// 和有序模式, inline模式一样, Handle panic只打日志, 不让整个进程退出
+	pool.PanicHandler = func(p interface{}) {
+		s.opts.Logger.Printf("handle exits from a panic: %v", p)
+	}
 	s.pool = pool
-	poolHandle, err := NewPoolHandle(defaultPoolHandleSize, s.handleConn.Read, s.handleConn.Handle, s)
+	poolHandle, err := NewTimingPoolHandle(opts.HandlePoolSize, poolHandleExpiry, s)
 	if err != nil {
 		return nil, err
 	}
@@ -121,37 +361,163 @@ func NewServer(addr string, HandleConn HandleConn, numPollEvent int, acceptBalan
 	return s, nil
 }
 
+// Start 监听所有地址并启动所有loop, loop运行起来后马上返回, 用Wait等待server结束, 地址格式见parseAddr
 func (s *server) Start() error {
-	ln, err := net.Listen("tcp", s.addr)
-	if err != nil {
-		return err
-	}
-	tcpListener := ln.(*net.TCPListener)
-	lnFile, err := tcpListener.File()
-	if err != nil {
-		return err
+	if s.numPollEvent <= 0 {
+		s.numPollEvent = runtime.NumCPU()
 	}
-	s.ln = &listener{
-		ln:     tcpListener,
-		fd:     int(lnFile.Fd()),
-		lnaddr: tcpListener.Addr(),
-		s:      s,
+	confs := append([]ListenerConfig{{Addr: s.addr, HandleConn: s.handleConn}}, s.opts.Listeners...)
+	for _, conf := range confs {
+		if err := s.listen(conf); err != nil {
+			return s.startFailed(err)
+		}
 	}
+	s.ln = s.lns[0]
 	return s.serving()
 }
 
+// listen ReusePort时tcp和udp地址每个loop监听一个, 后面的都绑到第一个实际监听的地址上, 端口为0时也是同一个端口
+func (s *server) listen(conf ListenerConfig) error {
+	handleConn := conf.HandleConn
+	if handleConn == nil {
+		handleConn = s.handleConn
+	}
+	network, address := parseAddr(conf.Addr)
+	if _, ok := handleConn.(PacketHandler); isUDP(network) && !ok {
+		return ErrNoPacketHandler
+	}
+	reusePort := s.opts.ReusePort && network != "unix"
+	n := 1
+	if reusePort {
+		n = s.numPollEvent
+	}
+	group := make([]*listener, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := listen(network, address, s.opts, reusePort)
+		if err != nil {
+			return err
+		}
+		ln.s = s
+		ln.handleConn = handleConn
+		ln.codec = s.opts.Codec
+		if ln.codec == nil {
+			ln.codec = &readCodec{read: handleConn.Read}
+		}
+		if reusePort {
+			ln.loop = i
+			address = ln.lnaddr.String()
+		}
+		s.lns = append(s.lns, ln)
+		group = append(group, ln)
+	}
+	if reusePort && s.opts.ReusePortSteer != SteerKernel {
+		return attachReusePortCBPF(group[0].fd, s.opts.ReusePortSteer, n)
+	}
+	return nil
+}
+
+// listenerOf fd是不是某个listener的fd, 不是时返回nil
+func (s *server) listenerOf(fd int) *listener {
+	for _, ln := range s.lns {
+		if ln.fd == fd {
+			return ln
+		}
+	}
+	return nil
+}
+
+func (s *server) startFailed(err error) error {
+	s.setErr(err)
+	s.Stop()
+	close(s.done)
+	return err
+}
+
+// Wait 阻塞到server停止, 返回导致loop退出的错误, 正常Stop返回nil
+func (s *server) Wait() error {
+	<-s.done
+	return s.err
+}
+
 func (s *server) Stop() {
-	for _, l := range s.pollEvents {
-		l.poll.triggerClose()
+	s.stopOnce.Do(func() {
+		atomic.StoreInt32(&s.shutdown, 1)
+		for _, l := range s.pollEvents {
+			l.poll.triggerClose()
+		}
+		s.wg.Wait()
+		// loop退出前没来得及执行的task, 比如还没注册完的新连接, 在这里执行掉
+		for _, l := range s.pollEvents {
+			l.poll.runTasks()
+		}
+		s.connManager.CloseAllConn()
+		for _, l := range s.pollEvents {
+			l.poll.close()
+		}
+		for _, ln := range s.lns {
+			ln.Close()
+		}
+		s.pool.Release()
+		s.poolHandle.Release()
+	})
+}
+
+/**
+ * Shutdown 优雅关闭: 先停止accept和读新数据, 等已经读出来的数据和正在执行的Handle处理完,
+ * 每个连接调用一次OnShutdown, 再等待连接上的数据写完, 最后Stop
+ * ctx到期时不再等待, 直接Stop, 返回ctx.Err()
+ */
+func (s *server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.shutdown, 0, 1) {
+		return ErrServerClosed
+	}
+	s.stopAccept()
+	if err := s.waitFor(ctx, func() bool {
+		return atomic.LoadInt64(&s.pendingReads) == 0 && atomic.LoadInt64(&s.runningHandle) == 0
+	}); err != nil {
+		s.Stop()
+		return err
 	}
-	s.wg.Wait()
-	s.connManager.CloseAllConn()
-	for _, l := range s.pollEvents {
-		l.poll.close()
+	s.connManager.conns.Range(func(key, value interface{}) bool {
+		c := value.(*conn)
+		if c.ref() {
+			c.handleConn.OnShutdown(c.handle)
+			c.unref()
+		}
+		return true
+	})
+	if err := s.waitFor(ctx, func() bool {
+		return atomic.LoadInt64(&s.runningHandle) == 0 && !s.connManager.hasPendingWrite() && !s.hasPendingPackets()
+	}); err != nil {
+		s.Stop()
+		return err
+	}
+	s.Stop()
+	return nil
+}
+
+func (s *server) hasPendingPackets() bool {
+	for _, e := range s.pollEvents {
+		for _, p := range e.pkts {
+			if p.hasPending() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *server) waitFor(ctx context.Context, done func() bool) error {
+	ticker := time.NewTicker(defaultShutdownPollInterval)
+	defer ticker.Stop()
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
-	s.ln.Close()
-	s.pool.Release()
-	s.poolHandle.Release()
+	return nil
 }
 func (s *server) Serve() error {
 	if s.preServing != nil {
@@ -161,5 +527,5 @@ func (s *server) Serve() error {
 	if err := s.Start(); err != nil {
 		return err
 	}
-	return nil
+	return s.Wait()
 }
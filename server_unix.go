@@ -10,48 +10,78 @@ package tfg
 
 import (
 	"golang.org/x/sys/unix"
-	"runtime"
 )
 
 func (s *server) serving() error {
-	if err := unix.SetNonblock(s.ln.fd, true); err != nil {
-		return err
-	}
-	if s.numPollEvent <= 0 {
-		s.numPollEvent = runtime.NumCPU()
+	for _, ln := range s.lns {
+		if err := unix.SetNonblock(ln.fd, true); err != nil {
+			return s.startFailed(err)
+		}
 	}
-	defer func() {
-		s.waitForShutdown()
-		s.Stop()
-	}()
 	for id := 0; id < s.numPollEvent; id++ {
-		poll, err := mkPoll()
+		poll, err := mkPoll(s.opts.EventBatch)
 		if err != nil {
-			return err
+			return s.startFailed(err)
 		}
 		event := &pollEvent{
 			id:   id,
 			poll: poll,
 			s:    s,
 		}
-		event.poll.addLn(s.ln.fd)
 		s.pollEvents = append(s.pollEvents, event)
+		for _, ln := range s.lns {
+			if !ln.onLoop(id) {
+				continue
+			}
+			if !ln.isUDP() {
+				event.poll.addLn(ln.fd)
+				continue
+			}
+			p, err := newPacketLoop(event, ln)
+			if err != nil {
+				return s.startFailed(err)
+			}
+			event.pkts = append(event.pkts, p)
+			// udp socket要等EPOLLOUT继续发送, 所有loop一起收
+			event.poll.addFd(ln.fd, 0)
+		}
 	}
 	s.wg.Add(len(s.pollEvents))
 	for _, pollEvent := range s.pollEvents {
 		go pollEvent.run()
 	}
+	go func() {
+		<-s.exit
+		s.Stop()
+		close(s.done)
+	}()
 	return nil
 }
 
-func (s *server) waitForShutdown() {
-	s.cond.L.Lock()
-	s.cond.Wait()
-	s.cond.L.Unlock()
+// signalShutdown 任意一个loop退出时整个server停止
+func (s *server) signalShutdown() {
+	s.exitOnce.Do(func() {
+		close(s.exit)
+	})
 }
 
-func (s *server) signalShutdown() {
-	s.cond.L.Lock()
-	s.cond.Signal()
-	s.cond.L.Unlock()
+/**
+ * stopAccept 从所有poll中摘掉listener, 不再接收新连接和数据报
+ * udp socket只关掉EPOLLIN, 还要等EPOLLOUT把队列里的回包发完, Stop时随socket一起关闭
+ */
+func (s *server) stopAccept() {
+	for _, pollEvent := range s.pollEvents {
+		for _, ln := range s.lns {
+			if !ln.onLoop(pollEvent.id) {
+				continue
+			}
+			if !ln.isUDP() {
+				pollEvent.poll.remove(ln.fd)
+				continue
+			}
+			if err := pollEvent.poll.modRead(ln.fd, 0, false); err != nil {
+				s.opts.Logger.Printf("stop udp read [fd:%v] [err:%v]", ln.fd, err)
+			}
+		}
+	}
 }
@@ -0,0 +1,71 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+const (
+	// skfAdOff SKF_AD_OFF(-0x1000), cBPF从这个偏移开始读的是内核提供的辅助数据
+	skfAdOff    = 0xfffff000
+	skfAdRxhash = 32
+	skfAdCPU    = 36
+)
+
+// attachReusePortCBPF 给fd所在的SO_REUSEPORT组挂cBPF程序, 程序返回组里socket的下标, 即监听顺序, 也就是loop的id
+func attachReusePortCBPF(fd int, steer ReusePortSteer, n int) error {
+	ad := uint32(skfAdCPU)
+	if steer == SteerHash {
+		ad = skfAdRxhash
+	}
+	prog := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: skfAdOff + ad},
+		{Code: unix.BPF_ALU | unix.BPF_MOD | unix.BPF_K, K: uint32(n)},
+		{Code: unix.BPF_RET | unix.BPF_A},
+	}
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, &unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	})
+}
+
+// apply tcp为false时是unix socket, 跳过NoDelay和KeepAlive
+func (o *SocketOptions) apply(fd int, tcp bool) error {
+	if tcp && o.NoDelay {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); err != nil {
+			return err
+		}
+	}
+	if tcp && o.KeepAlive > 0 {
+		secs := int(o.KeepAlive / time.Second)
+		if secs < 1 {
+			secs = 1
+		}
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+			return err
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, secs); err != nil {
+			return err
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, secs); err != nil {
+			return err
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"container/heap"
+	"time"
+)
+
+const (
+	TIMER_READ int = iota
+	TIMER_WRITE
+	TIMER_IDLE
+)
+
+type timer struct {
+	when  int64
+	kind  int
+	c     *conn
+	id    uint64
+	index int
+}
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool { return h[i].when < h[j].when }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
+
+/**
+ * resetTimer when为0时从堆里删掉, 变成最早到期的timer时唤醒loop重新计算wait的超时时间
+ * stopTimers之后不再放回堆里, 否则conn被复用时reset会改掉还在堆里的timer
+ */
+func (e *pollEvent) resetTimer(t *timer, when int64) {
+	e.timerMu.Lock()
+	if when == 0 || t.c.timersStopped {
+		if t.index >= 0 {
+			heap.Remove(&e.timers, t.index)
+		}
+		e.timerMu.Unlock()
+		return
+	}
+	t.when = when
+	t.id = t.c.ID()
+	if t.index >= 0 {
+		heap.Fix(&e.timers, t.index)
+	} else {
+		heap.Push(&e.timers, t)
+	}
+	earliest := t.index == 0
+	e.timerMu.Unlock()
+	if earliest {
+		e.poll.wakeup()
+	}
+}
+
+// stopTimers 连接关闭时调用, 和resetTimer在同一把锁下标记, 之后这个连接的timer不会再进堆
+func (e *pollEvent) stopTimers(c *conn) {
+	e.timerMu.Lock()
+	c.timersStopped = true
+	for _, t := range []*timer{&c.readTimer, &c.writeTimer, &c.idleTimer} {
+		if t.index >= 0 {
+			heap.Remove(&e.timers, t.index)
+		}
+	}
+	e.timerMu.Unlock()
+}
+
+// nextTimeout 返回给epoll wait用的超时时间(毫秒), 没有timer时返回-1一直等
+func (e *pollEvent) nextTimeout() int {
+	e.timerMu.Lock()
+	defer e.timerMu.Unlock()
+	if len(e.timers) == 0 {
+		return -1
+	}
+	d := time.Duration(e.timers[0].when - time.Now().UnixNano())
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+func (e *pollEvent) expiredTimers(now int64) []*timer {
+	e.timerMu.Lock()
+	defer e.timerMu.Unlock()
+	var expired []*timer
+	for len(e.timers) > 0 && e.timers[0].when <= now {
+		expired = append(expired, heap.Pop(&e.timers).(*timer))
+	}
+	return expired
+}
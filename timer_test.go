@@ -0,0 +1,136 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"testing"
+	"time"
+)
+
+func newTimerLoop(t *testing.T) *pollEvent {
+	p, err := mkPoll(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pollEvent{poll: p}
+}
+
+func newTimerConn(id uint64) *conn {
+	c := &conn{id: id}
+	c.readTimer = timer{kind: TIMER_READ, c: c, index: -1}
+	c.writeTimer = timer{kind: TIMER_WRITE, c: c, index: -1}
+	c.idleTimer = timer{kind: TIMER_IDLE, c: c, index: -1}
+	return c
+}
+
+// checkTimerIndex 堆里每个timer的index都要和它的位置一致, 否则heap.Remove会删错
+func checkTimerIndex(t *testing.T, e *pollEvent) {
+	for i, tm := range e.timers {
+		if tm.index != i {
+			t.Fatalf("timer at %d has index %d", i, tm.index)
+		}
+	}
+}
+
+func TestTimerHeapExpired(t *testing.T) {
+	e := newTimerLoop(t)
+	defer e.poll.close()
+	whens := []int64{50, 10, 40, 20, 30, 60}
+	var conns []*conn
+	for i, when := range whens {
+		c := newTimerConn(uint64(i + 1))
+		conns = append(conns, c)
+		e.resetTimer(&c.readTimer, when)
+	}
+	checkTimerIndex(t, e)
+	expired := e.expiredTimers(35)
+	var got []int64
+	for _, tm := range expired {
+		got = append(got, tm.when)
+		if tm.index != -1 {
+			t.Fatalf("expired timer index = %d", tm.index)
+		}
+	}
+	if len(got) != 3 || got[0] != 10 || got[1] != 20 || got[2] != 30 {
+		t.Fatalf("expired = %v", got)
+	}
+	if e.timers.Len() != 3 || e.timers[0].when != 40 {
+		t.Fatalf("left %d timers, first %d", e.timers.Len(), e.timers[0].when)
+	}
+	checkTimerIndex(t, e)
+	if tm := expired[0]; tm.c != conns[1] || tm.id != 2 || tm.kind != TIMER_READ {
+		t.Fatalf("expired timer conn id = %d kind = %d", tm.id, tm.kind)
+	}
+}
+
+func TestResetTimer(t *testing.T) {
+	e := newTimerLoop(t)
+	defer e.poll.close()
+	a, b := newTimerConn(1), newTimerConn(2)
+	e.resetTimer(&a.readTimer, 100)
+	e.resetTimer(&a.idleTimer, 300)
+	e.resetTimer(&b.writeTimer, 200)
+	// 已经在堆里的timer只调整位置, 不会重复放进去
+	e.resetTimer(&a.readTimer, 400)
+	if e.timers.Len() != 3 || e.timers[0] != &b.writeTimer {
+		t.Fatalf("len = %d, first = %+v", e.timers.Len(), e.timers[0])
+	}
+	e.resetTimer(&a.idleTimer, 50)
+	if e.timers[0] != &a.idleTimer {
+		t.Fatalf("first = %+v", e.timers[0])
+	}
+	checkTimerIndex(t, e)
+	e.resetTimer(&b.writeTimer, 0)
+	if e.timers.Len() != 2 || b.writeTimer.index != -1 {
+		t.Fatalf("len = %d, removed index = %d", e.timers.Len(), b.writeTimer.index)
+	}
+	// 不在堆里的timer删一次也没关系
+	e.resetTimer(&b.writeTimer, 0)
+	if e.timers.Len() != 2 {
+		t.Fatalf("len = %d", e.timers.Len())
+	}
+	checkTimerIndex(t, e)
+}
+
+func TestStopTimers(t *testing.T) {
+	e := newTimerLoop(t)
+	defer e.poll.close()
+	a, b := newTimerConn(1), newTimerConn(2)
+	e.resetTimer(&a.readTimer, 10)
+	e.resetTimer(&a.writeTimer, 20)
+	e.resetTimer(&b.idleTimer, 30)
+	e.resetTimer(&a.idleTimer, 40)
+	e.stopTimers(a)
+	if e.timers.Len() != 1 || e.timers[0] != &b.idleTimer {
+		t.Fatalf("len = %d after stop", e.timers.Len())
+	}
+	checkTimerIndex(t, e)
+	// 关闭之后SetDeadline之类的再设置也不会放回堆里
+	e.resetTimer(&a.readTimer, 5)
+	if e.timers.Len() != 1 || a.readTimer.index != -1 {
+		t.Fatalf("stopped timer pushed back, len = %d", e.timers.Len())
+	}
+}
+
+func TestNextTimeout(t *testing.T) {
+	e := newTimerLoop(t)
+	defer e.poll.close()
+	if d := e.nextTimeout(); d != -1 {
+		t.Fatalf("empty timeout = %d", d)
+	}
+	c := newTimerConn(1)
+	now := time.Now().UnixNano()
+	e.resetTimer(&c.readTimer, now-int64(time.Second))
+	if d := e.nextTimeout(); d != 0 {
+		t.Fatalf("expired timeout = %d", d)
+	}
+	// 不足1毫秒向上取整, 不会提前醒过来
+	e.resetTimer(&c.readTimer, now+int64(time.Hour)+int64(900*time.Microsecond))
+	if d := e.nextTimeout(); d != int(time.Hour/time.Millisecond)+1 {
+		t.Fatalf("timeout = %d", d)
+	}
+}
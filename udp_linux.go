@@ -0,0 +1,316 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// PacketConn udp数据报的回包句柄, 绑定了收到数据报的loop和来源地址, 可以保留下来之后再回包
+type PacketConn interface {
+	// Write 用sendto发回给数据报的来源地址
+	Write(b []byte) (int, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+type packetConn struct {
+	p     *packetLoop
+	raddr net.Addr
+	name  unix.RawSockaddrAny
+	nlen  uint32
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	return c.p.send(b, &c.name, c.nlen)
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, ErrInputConnWrite
+	}
+	var name unix.RawSockaddrAny
+	nlen, err := udpToSockaddr(udpAddr, c.p.family, &name)
+	if err != nil {
+		return 0, err
+	}
+	return c.p.send(b, &name, nlen)
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.p.ln.lnaddr
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// packetReq 交给协程池执行HandlePacket的一个数据报
+type packetReq struct {
+	c   *packetConn
+	buf []byte
+	n   int
+}
+
+type outPacket struct {
+	b    []byte
+	name unix.RawSockaddrAny
+	nlen uint32
+}
+
+/**
+ * packetLoop 一个pollEvent上的udp收发状态
+ * 收: EPOLLIN时用recvmmsg一次收一批, 每个数据报拷贝出来交给HandlePacket
+ * 发: 回包先进队列, 这一轮loop结束时用sendmmsg一次发一批, EAGAIN时等EPOLLOUT
+ */
+type packetLoop struct {
+	e      *pollEvent
+	ln     *listener
+	fd     int
+	family int
+
+	rhdrs  []mmsghdr
+	riovs  []unix.Iovec
+	rnames []unix.RawSockaddrAny
+	rbufs  [][]byte
+
+	outMu   sync.Mutex
+	out     []outPacket
+	queued  int64
+	sending []outPacket
+	shdrs   []mmsghdr
+	siovs   []unix.Iovec
+}
+
+func newPacketLoop(e *pollEvent, ln *listener) (*packetLoop, error) {
+	fd := ln.fd
+	family, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return nil, err
+	}
+	batch, size := e.s.opts.UDPBatch, e.s.opts.UDPPacketSize
+	p := &packetLoop{
+		e:      e,
+		ln:     ln,
+		fd:     fd,
+		family: family,
+		rhdrs:  make([]mmsghdr, batch),
+		riovs:  make([]unix.Iovec, batch),
+		rnames: make([]unix.RawSockaddrAny, batch),
+		rbufs:  make([][]byte, batch),
+		shdrs:  make([]mmsghdr, batch),
+		siovs:  make([]unix.Iovec, batch),
+	}
+	for i := range p.rbufs {
+		p.rbufs[i] = make([]byte, size)
+		p.riovs[i].Base = &p.rbufs[i][0]
+		p.riovs[i].SetLen(size)
+	}
+	return p, nil
+}
+
+// read 收到EAGAIN为止, 超过UDPPacketSize被截断的数据报直接丢掉
+func (p *packetLoop) read() {
+	for {
+		if p.e.s.isShutdown() {
+			return
+		}
+		for i := range p.rhdrs {
+			h := &p.rhdrs[i].hdr
+			h.Name = (*byte)(unsafe.Pointer(&p.rnames[i]))
+			h.Namelen = unix.SizeofSockaddrAny
+			h.Iov = &p.riovs[i]
+			h.Iovlen = 1
+			h.Flags = 0
+			p.rhdrs[i].n = 0
+		}
+		n, err := recvmmsg(p.fd, p.rhdrs)
+		if err != nil {
+			if err != unix.EAGAIN {
+				p.e.s.opts.Logger.Printf("udp recvmmsg [fd:%v] [err:%v]", p.fd, err)
+			}
+			return
+		}
+		for i := 0; i < n; i++ {
+			h := &p.rhdrs[i]
+			if h.hdr.Flags&unix.MSG_TRUNC != 0 {
+				p.e.s.opts.Logger.Printf("udp packet larger than %v dropped", len(p.rbufs[i]))
+				continue
+			}
+			p.deliver(p.rbufs[i][:h.n], &p.rnames[i], h.hdr.Namelen)
+		}
+		if n < len(p.rhdrs) {
+			return
+		}
+	}
+}
+
+func (p *packetLoop) deliver(data []byte, name *unix.RawSockaddrAny, nlen uint32) {
+	s := p.e.s
+	c := &packetConn{p: p, name: *name, nlen: nlen}
+	c.raddr = sockaddrToUDP(name)
+	var buf []byte
+	if len(data) > s.bufPool.max() {
+		buf = make([]byte, len(data))
+	} else {
+		buf = s.bufPool.get(len(data))
+	}
+	n := copy(buf, data)
+	req := s.connManager.packetReqCache.Get().(*packetReq)
+	req.c, req.buf, req.n = c, buf, n
+	atomic.AddInt64(&s.runningHandle, 1)
+	if s.opts.HandleMode == HandleInline {
+		s.handlePacketInline(req)
+		return
+	}
+	if err := s.pool.Serve(req); err != nil {
+		s.putPacketReq(req)
+		atomic.AddInt64(&s.runningHandle, -1)
+		s.opts.Logger.Printf("udp packet dropped [err:%v]", err)
+	}
+}
+
+// send 拷贝一份b进发送队列, 队列从空变成非空时唤醒loop
+func (p *packetLoop) send(b []byte, name *unix.RawSockaddrAny, nlen uint32) (int, error) {
+	if len(b) == 0 {
+		return 0, ErrInputConnWrite
+	}
+	if atomic.LoadUint32(&p.e.poll.status) == POLL_CLOSED {
+		return 0, ErrServerClosed
+	}
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	p.outMu.Lock()
+	p.out = append(p.out, outPacket{b: buf, name: *name, nlen: nlen})
+	atomic.AddInt64(&p.queued, 1)
+	first := len(p.out) == 1
+	p.outMu.Unlock()
+	if first {
+		p.e.poll.wakeup()
+	}
+	return len(b), nil
+}
+
+// flush 只在loop协程上执行, 每轮loop结束和EPOLLOUT时调用
+func (p *packetLoop) flush() {
+	if atomic.LoadInt64(&p.queued) == 0 {
+		return
+	}
+	p.outMu.Lock()
+	p.sending = append(p.sending, p.out...)
+	for i := range p.out {
+		p.out[i] = outPacket{}
+	}
+	p.out = p.out[:0]
+	p.outMu.Unlock()
+	for len(p.sending) > 0 {
+		m := len(p.sending)
+		if m > len(p.shdrs) {
+			m = len(p.shdrs)
+		}
+		for i := 0; i < m; i++ {
+			out := &p.sending[i]
+			p.siovs[i].Base = &out.b[0]
+			p.siovs[i].SetLen(len(out.b))
+			p.shdrs[i] = mmsghdr{}
+			p.shdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&out.name))
+			p.shdrs[i].hdr.Namelen = out.nlen
+			p.shdrs[i].hdr.Iov = &p.siovs[i]
+			p.shdrs[i].hdr.Iovlen = 1
+		}
+		n, err := sendmmsg(p.fd, p.shdrs[:m])
+		for i := 0; i < m; i++ {
+			p.shdrs[i] = mmsghdr{}
+			p.siovs[i] = unix.Iovec{}
+		}
+		if err != nil {
+			if err == unix.EAGAIN {
+				return
+			}
+			// 第一个包发不出去(比如地址不可达), 丢掉它接着发后面的
+			p.e.s.opts.Logger.Printf("udp sendmmsg [fd:%v] [err:%v]", p.fd, err)
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			p.sending[i] = outPacket{}
+		}
+		p.sending = p.sending[n:]
+		atomic.AddInt64(&p.queued, -int64(n))
+	}
+	p.sending = nil
+}
+
+func (p *packetLoop) hasPending() bool {
+	return atomic.LoadInt64(&p.queued) > 0
+}
+
+func sockaddrToUDP(rsa *unix.RawSockaddrAny) net.Addr {
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		pp := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return &net.UDPAddr{
+			IP:   net.IPv4(pp.Addr[0], pp.Addr[1], pp.Addr[2], pp.Addr[3]),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	case unix.AF_INET6:
+		pp := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		var zone string
+		if pp.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(pp.Scope_id)); err == nil {
+				zone = ifi.Name
+			}
+		}
+		return &net.UDPAddr{
+			IP:   append([]byte{}, pp.Addr[:]...),
+			Port: int(port[0])<<8 | int(port[1]),
+			Zone: zone,
+		}
+	}
+	return nil
+}
+
+// udpToSockaddr 按socket的family填sockaddr, AF_INET6的socket发往ipv4地址时用v4-mapped地址
+func udpToSockaddr(addr *net.UDPAddr, family int, rsa *unix.RawSockaddrAny) (uint32, error) {
+	switch family {
+	case unix.AF_INET:
+		ip := addr.IP.To4()
+		if ip == nil {
+			return 0, unix.EAFNOSUPPORT
+		}
+		pp := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		pp.Family = unix.AF_INET
+		port := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+		copy(pp.Addr[:], ip)
+		return unix.SizeofSockaddrInet4, nil
+	case unix.AF_INET6:
+		ip := addr.IP.To16()
+		if ip == nil {
+			return 0, unix.EAFNOSUPPORT
+		}
+		pp := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		pp.Family = unix.AF_INET6
+		port := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+		copy(pp.Addr[:], ip)
+		if addr.Zone != "" {
+			if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+				pp.Scope_id = uint32(ifi.Index)
+			}
+		}
+		return unix.SizeofSockaddrInet6, nil
+	}
+	return 0, unix.EAFNOSUPPORT
+}
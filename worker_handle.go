@@ -8,7 +8,7 @@
 package tfg
 
 import (
-	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +22,7 @@ type WorkerHandle struct {
 
 type connWorker struct {
 	conn *conn
+	id   uint64
 	in   []byte
 	n    int
 }
@@ -36,36 +37,88 @@ func (w *WorkerHandle) run() {
 				if w.pool.PanicHandler != nil {
 					w.pool.PanicHandler(p)
 				} else {
-					log.Printf("worker exits from a panic: %v", p)
+					w.pool.s.opts.Logger.Printf("worker exits from a panic: %v", p)
 				}
 			}
 		}()
 
-		var remain []byte
-		var packet interface{}
-		var isFinRead, isHandle bool
-		var err error
 		for connWorker := range w.connCh {
 			if nil == connWorker || connWorker.conn == nil {
 				w.pool.decRunning()
 				w.pool.workerCache.Put(w)
 				return
 			}
-			packet, remain, isFinRead, isHandle, err = w.pool.read(connWorker.in[:connWorker.n], remain)
-			if isHandle {
-				req := w.pool.s.connManager.handleReqCache.Get().(*handleReq)
-				req.conn = connWorker.conn
-				req.packet = packet
-				req.err = err
-				w.pool.s.pool.Serve(req)
-			}
-			if isFinRead {
-				w.pool.s.connManager.inCache.Put(connWorker)
+			id := connWorker.id
+			finRead := w.handleChunk(connWorker)
+			if w.pool.unbindConnWorker(id, finRead) {
 				if ok := w.pool.revertWorker(w); !ok {
 					break
 				}
-				w.pool.deleteConnWorker(connWorker.conn.fd)
 			}
 		}
 	}()
 }
+
+// handleChunk 处理一个数据块, 数据块持有conn的一个引用, 放掉之前conn不会被复用, 连接已经关闭时直接丢掉
+// 中途panic了也要把计数减掉, 否则连接关不掉, Shutdown也一直等
+func (w *WorkerHandle) handleChunk(cw *connWorker) (finRead bool) {
+	s := w.pool.s
+	c := cw.conn
+	defer func() {
+		if p := recover(); p != nil {
+			n := c.inbound.Len()
+			c.inbound.Reset()
+			c.releaseInbound(n)
+			s.opts.Logger.Printf("handle conn exits from a panic: %v", p)
+		}
+		atomic.AddInt64(&c.queued, -1)
+		c.closeIfIdle()
+		// 关闭的连接上剩下的半个包不会再有后续数据了
+		finRead = c.inbound.Len() == 0 || c.isClosed()
+		c.unref()
+		atomic.AddInt64(&s.pendingReads, -1)
+	}()
+	closed := c.isClosed()
+	if !closed {
+		c.inbound.write(cw.in[:cw.n])
+	}
+	s.putConnWorker(cw)
+	if !closed {
+		decodeInbound(c.codec, c, s.dispatch)
+	}
+	return
+}
+
+// decodeInbound 从连接的InboundBuffer里不断取出完整的msg交给deliver, 直到数据不够
+// 没有变成msg就被消费掉的字节马上释放, 其余的跟着msg在Handle执行完后释放
+func decodeInbound(codec Codec, c *conn, deliver func(c *conn, msg interface{}, err error, n int) error) {
+	for c.inbound.Len() > 0 {
+		n := c.inbound.Len()
+		msg, err := decodeSafely(codec, c)
+		if err != nil {
+			c.inbound.Reset()
+			deliver(c, msg, err, n)
+			return
+		}
+		consumed := n - c.inbound.Len()
+		if msg == nil {
+			c.releaseInbound(consumed)
+			return
+		}
+		deliver(c, msg, nil, consumed)
+		if consumed == 0 {
+			return
+		}
+	}
+}
+
+// decodeSafely Decode panic了当成解码出错, 缓存的数据丢掉, Handle收到ErrDecodePanic
+func decodeSafely(codec Codec, c *conn) (msg interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			c.s.opts.Logger.Printf("decode exits from a panic: %v", p)
+			msg, err = nil, ErrDecodePanic
+		}
+	}()
+	return codec.Decode(&c.inbound)
+}
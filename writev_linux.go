@@ -0,0 +1,55 @@
+/**
+ * @Author: llh
+ * @Date:   2019-06-01 15:08:12
+ * @Last Modified by:   llh
+ */
+
+package tfg
+
+import (
+	"golang.org/x/sys/unix"
+	"unsafe"
+)
+
+// maxIovec linux单次writev最多的buffer块数(IOV_MAX)
+const maxIovec = 1024
+
+/**
+ * writev 一次系统调用写出多块buffer, 空的buffer跳过, 超过maxIovec块时只写前面的
+ * iovs是调用方复用的临时空间, 返回扩容后的iovs
+ */
+func writev(fd int, bufs [][]byte, iovs []unix.Iovec) ([]unix.Iovec, int, error) {
+	iovs = iovs[:0]
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+		if len(iovs) == maxIovec {
+			break
+		}
+		iov := unix.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		iovs = append(iovs, iov)
+	}
+	if len(iovs) == 0 {
+		return iovs, 0, nil
+	}
+	var (
+		n     uintptr
+		errno unix.Errno
+	)
+	for {
+		n, _, errno = unix.Syscall(unix.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+		if errno != unix.EINTR {
+			break
+		}
+	}
+	// 不再引用调用方的buffer, 让它们可以被回收
+	for i := range iovs {
+		iovs[i] = unix.Iovec{}
+	}
+	if errno != 0 {
+		return iovs, 0, errno
+	}
+	return iovs, int(n), nil
+}